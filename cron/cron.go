@@ -0,0 +1,248 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed standard 5-field cron expression:
+// minute, hour, day of month, month and day of week
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Like cron, when both day fields are restricted a day matching either runs
+	domStar, dowStar bool
+}
+
+type bounds struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteBounds = bounds{name: "minute", min: 0, max: 59}
+	hourBounds   = bounds{name: "hour", min: 0, max: 23}
+	domBounds    = bounds{name: "day of month", min: 1, max: 31}
+	monthBounds  = bounds{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Both 0 and 7 are sunday
+	dowBounds = bounds{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// maxYears is how far ahead Next looks before deciding a schedule never fires,
+// long enough to find any 29th of february
+const maxYears = 5
+
+// Parse parses a 5-field cron expression such as "30 7,19 * * mon-fri".
+// Fields accept *, numbers, names for months and weekdays, ranges, lists and
+// steps.
+func Parse(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: expected 5 fields, found %d", len(fields))
+	}
+
+	var s Schedule
+	var err error
+	if s.minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], hourBounds); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], domBounds); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], monthBounds); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], dowBounds); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+
+	if s.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, fmt.Errorf("cron: %q never runs", expr)
+	}
+	return &s, nil
+}
+
+// Next returns the first time strictly after t that the schedule fires, in
+// t's location, or the zero time if it never fires. Wall clock times are
+// turned into instants by Date, so times skipped when daylight saving time
+// starts fire once when the clocks go forward, and times repeated when it
+// ends only fire the first time.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	after := t
+
+	// Search the wall clock times in loc, which never skip or repeat
+	w := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := w.Year() + maxYears
+
+	for w.Year() <= limit {
+		if s.month&(1<<uint(w.Month())) == 0 {
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(w) {
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(w.Hour())) == 0 {
+			w = time.Date(w.Year(), w.Month(), w.Day(), w.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.minute&(1<<uint(w.Minute())) != 0 {
+			// Several skipped times share an instant, and the second time
+			// through a repeated hour is before its first, so check it is
+			// really later
+			next := Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, loc)
+			if next.After(after) {
+				return next
+			}
+		}
+		w = w.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+// Date is like time.Date, but says what happens to wall clock times when
+// daylight saving time changes, where time.Date could pick either way. A time
+// skipped when the clocks go forward is the moment they go forward, so
+// 02:30 on the day the clocks go from 02:00 to 03:00 is 03:00. A time
+// repeated when they go back is the first time it happens.
+//
+// Backup schedules, whether cron expressions or a frequency and time, both
+// use Date, so they behave the same way.
+func Date(year int, month time.Month, day, hour, min, sec int, loc *time.Location) time.Time {
+	want := time.Date(year, month, day, hour, min, sec, 0, time.UTC)
+	t := time.Date(year, month, day, hour, min, sec, 0, loc)
+
+	got := wall(t)
+	switch {
+	case got.Equal(want):
+		// Pick the first of a repeated time, the clocks went back if the
+		// offset was larger a day ago
+		_, offset := t.Zone()
+		_, before := t.Add(-24 * time.Hour).Zone()
+		if before > offset {
+			earlier := t.Add(-time.Duration(before-offset) * time.Second)
+			if wall(earlier).Equal(want) {
+				return earlier
+			}
+		}
+		return t
+	case got.Before(want):
+		// Resolved to before the gap, walk forward to its end
+		for wall(t).Before(want) {
+			t = t.Add(time.Minute)
+		}
+	default:
+		// Resolved to after the gap, walk back to its start
+		for !wall(t.Add(-time.Minute)).Before(want) {
+			t = t.Add(-time.Minute)
+		}
+	}
+	// Clocks change on the minute
+	return t.Truncate(time.Minute)
+}
+
+// wall returns t's wall clock time as if it were in UTC
+func wall(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseField parses a comma separated list of ranges into a bit set
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		r, err := parseRange(part, b)
+		if err != nil {
+			return 0, err
+		}
+		bits |= r
+	}
+	return bits, nil
+}
+
+// parseRange parses *, a single value or a range, each with an optional step
+func parseRange(part string, b bounds) (uint64, error) {
+	rng, step := part, 1
+	if i := strings.Index(part, "/"); i >= 0 {
+		rng = part[:i]
+		n, err := strconv.Atoi(part[i+1:])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("cron: invalid step in %s %q", b.name, part)
+		}
+		step = n
+	}
+
+	var lo, hi int
+	switch {
+	case rng == "*":
+		lo, hi = b.min, b.max
+	case strings.Contains(rng, "-"):
+		i := strings.Index(rng, "-")
+		var err error
+		if lo, err = parseValue(rng[:i], b); err != nil {
+			return 0, err
+		}
+		if hi, err = parseValue(rng[i+1:], b); err != nil {
+			return 0, err
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("cron: backwards range in %s %q", b.name, part)
+		}
+	default:
+		var err error
+		if lo, err = parseValue(rng, b); err != nil {
+			return 0, err
+		}
+		hi = lo
+		// "5/15" means every 15 starting at 5
+		if step > 1 {
+			hi = b.max
+		}
+	}
+
+	var bits uint64
+	for v := lo; v <= hi; v += step {
+		bits |= 1 << uint(v)
+	}
+	return bits, nil
+}
+
+func parseValue(s string, b bounds) (int, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("cron: invalid %s %q", b.name, s)
+	}
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("cron: %s %d out of range %d-%d", b.name, v, b.min, b.max)
+	}
+	return v, nil
+}
@@ -0,0 +1,207 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"0 0 31 2 *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+
+	tests := []struct {
+		name  string
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{
+			name:  "weekdays skip the weekend",
+			expr:  "30 7 * * mon-fri",
+			after: time.Date(2024, 1, 5, 8, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 8, 7, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "steps",
+			expr:  "*/15 * * * *",
+			after: time.Date(2024, 1, 1, 10, 7, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC),
+		},
+		{
+			name:  "step from a value",
+			expr:  "5/20 * * * *",
+			after: time.Date(2024, 1, 1, 10, 6, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 1, 10, 25, 0, 0, time.UTC),
+		},
+		{
+			name:  "strictly after",
+			expr:  "0 12 * * *",
+			after: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "7 is sunday",
+			expr:  "0 12 * * 7",
+			after: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 7, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "month names",
+			expr:  "0 0 1 jan,jul *",
+			after: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "either restricted day field matches",
+			expr:  "0 0 13 * fri",
+			after: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "day of month alone",
+			expr:  "0 0 13 * *",
+			after: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "both day fields when one starts with *",
+			expr:  "0 0 */2 * mon",
+			after: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "leap day",
+			expr:  "0 0 29 2 *",
+			after: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "skipped time runs when the clocks go forward",
+			expr:  "30 2 * * *",
+			after: time.Date(2024, 3, 10, 0, 0, 0, 0, ny),
+			want:  time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "skipped time is back to normal the next day",
+			expr:  "30 2 * * *",
+			after: time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC).In(ny),
+			want:  time.Date(2024, 3, 11, 6, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "skipped times only run once",
+			expr:  "*/15 * * * *",
+			after: time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC).In(ny),
+			want:  time.Date(2024, 3, 10, 7, 15, 0, 0, time.UTC),
+		},
+		{
+			name:  "repeated time runs the first time",
+			expr:  "30 1 * * *",
+			after: time.Date(2024, 11, 3, 0, 0, 0, 0, ny),
+			want:  time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "repeated time doesn't run the second time",
+			expr:  "30 1 * * *",
+			after: time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC).In(ny),
+			want:  time.Date(2024, 11, 4, 6, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "repeated hour is skipped by hourly schedules",
+			expr:  "0 * * * *",
+			after: time.Date(2024, 11, 3, 5, 0, 0, 0, time.UTC).In(ny),
+			want:  time.Date(2024, 11, 3, 7, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Next(tt.after)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.after, got.UTC(), tt.want)
+			}
+			if got.Location() != tt.after.Location() {
+				t.Errorf("Next(%v) is in %v, want %v", tt.after, got.Location(), tt.after.Location())
+			}
+		})
+	}
+}
+
+func TestDate(t *testing.T) {
+	ny := mustLoad(t, "America/New_York")
+	kathmandu := mustLoad(t, "Asia/Kathmandu")
+
+	tests := []struct {
+		name string
+		got  time.Time
+		want time.Time
+	}{
+		{
+			name: "normal time",
+			got:  Date(2024, 6, 1, 9, 0, 0, ny),
+			want: time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "skipped time",
+			got:  Date(2024, 3, 10, 2, 30, 0, ny),
+			want: time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "start of skipped hour",
+			got:  Date(2024, 3, 10, 2, 0, 0, ny),
+			want: time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "repeated time",
+			got:  Date(2024, 11, 3, 1, 30, 0, ny),
+			want: time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "after the repeated hour",
+			got:  Date(2024, 11, 3, 2, 30, 0, ny),
+			want: time.Date(2024, 11, 3, 7, 30, 0, 0, time.UTC),
+		},
+		{
+			// Kathmandu moved from +05:30 to +05:45 at midnight
+			name: "skipped quarter hour",
+			got:  Date(1986, 1, 1, 0, 10, 0, kathmandu),
+			want: time.Date(1985, 12, 31, 18, 30, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", tt.got.UTC(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package dropbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/retry"
+)
+
+// Default endpoints for the dropbox api, used for tokens and by clients unless
+// told otherwise
+var (
+	DefaultAPIURL     = "https://api.dropboxapi.com"
+	DefaultContentURL = "https://content.dropboxapi.com"
+)
+
+const (
+	// maxSingleUpload is the largest file dropbox accepts through /files/upload
+	maxSingleUpload int64 = 150 << 20
+
+	// DefaultChunkSize is the size of each request in an upload session
+	DefaultChunkSize int64 = 8 << 20
+)
+
+var (
+	// ErrInsufficientSpace is returned when the user's dropbox is full
+	ErrInsufficientSpace = errors.New("dropbox: insufficient space")
+	// ErrInvalidToken is returned when the access token is invalid or expired
+	ErrInvalidToken = errors.New("dropbox: invalid access token")
+)
+
+// APIError describes a non-200 response from dropbox
+type APIError struct {
+	StatusCode int
+	Summary    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("dropbox: status %d: %s", e.StatusCode, e.Summary)
+}
+
+// Is lets errors.Is match an APIError against ErrInsufficientSpace and ErrInvalidToken
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrInvalidToken:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrInsufficientSpace:
+		return strings.Contains(e.Summary, "insufficient_space")
+	}
+	return false
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *APIError) Temporary() bool {
+	return retry.StatusTemporary(e.StatusCode)
+}
+
+// WriteMode decides what happens when the upload path already exists
+type WriteMode string
+
+// Write modes supported by dropbox
+const (
+	WriteModeAdd       WriteMode = "add"
+	WriteModeOverwrite WriteMode = "overwrite"
+)
+
+// UploadOptions controls how a file is committed to dropbox
+type UploadOptions struct {
+	Mode       WriteMode
+	Autorename bool
+}
+
+// FileMetadata is the subset of dropbox file metadata we care about
+type FileMetadata struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	PathDisplay    string    `json:"path_display"`
+	Size           int64     `json:"size"`
+	ServerModified time.Time `json:"server_modified"`
+	Rev            string    `json:"rev"`
+}
+
+// Client talks to the dropbox api with a short-lived access token
+type Client struct {
+	Token      string
+	APIURL     string
+	ContentURL string
+	ChunkSize  int64
+	HTTPClient *http.Client
+}
+
+// NewClient creates a client for the real dropbox api
+func NewClient(token string) *Client {
+	return &Client{
+		Token:      token,
+		APIURL:     DefaultAPIURL,
+		ContentURL: DefaultContentURL,
+		ChunkSize:  DefaultChunkSize,
+		HTTPClient: &http.Client{},
+	}
+}
+
+type commitInfo struct {
+	Path       string    `json:"path"`
+	Mode       WriteMode `json:"mode"`
+	Autorename bool      `json:"autorename"`
+	Mute       bool      `json:"mute"`
+}
+
+type sessionCursor struct {
+	SessionID string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+type sessionStartResult struct {
+	SessionID string `json:"session_id"`
+}
+
+type listFolderResult struct {
+	Entries []FileMetadata `json:"entries"`
+	Cursor  string         `json:"cursor"`
+	HasMore bool           `json:"has_more"`
+}
+
+// SpaceUsage is the user's used and allocated dropbox space in bytes
+type SpaceUsage struct {
+	Used       int64 `json:"used"`
+	Allocation struct {
+		Allocated int64 `json:"allocated"`
+	} `json:"allocation"`
+}
+
+type errorResponse struct {
+	ErrorSummary string `json:"error_summary"`
+}
+
+// Upload writes size bytes from r to path, using an upload session when the
+// file is too big for a single request. A negative size means unknown.
+func (c *Client) Upload(ctx context.Context, path string, r io.Reader, size int64, opts UploadOptions) (*FileMetadata, error) {
+	if opts.Mode == "" {
+		opts.Mode = WriteModeAdd
+	}
+	commit := commitInfo{Path: path, Mode: opts.Mode, Autorename: opts.Autorename}
+
+	if size >= 0 && size <= c.chunkSize() {
+		var meta FileMetadata
+		err := c.content(ctx, "/2/files/upload", commit, r, &meta)
+		if err != nil {
+			return nil, err
+		}
+		return &meta, nil
+	}
+
+	return c.uploadSession(ctx, commit, r)
+}
+
+// ListFolder returns the files directly inside path, following pagination
+func (c *Client) ListFolder(ctx context.Context, path string) ([]FileMetadata, error) {
+	var res listFolderResult
+	err := c.rpc(ctx, "/2/files/list_folder", struct {
+		Path string `json:"path"`
+	}{path}, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := res.Entries
+	for res.HasMore {
+		cursor := res.Cursor
+		res = listFolderResult{}
+		err = c.rpc(ctx, "/2/files/list_folder/continue", struct {
+			Cursor string `json:"cursor"`
+		}{cursor}, &res)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, res.Entries...)
+	}
+
+	files := entries[:0]
+	for _, e := range entries {
+		// Folders have no rev
+		if e.Rev != "" {
+			files = append(files, e)
+		}
+	}
+	return files, nil
+}
+
+// GetMetadata returns the metadata of the file at path
+func (c *Client) GetMetadata(ctx context.Context, path string) (*FileMetadata, error) {
+	var meta FileMetadata
+	err := c.rpc(ctx, "/2/files/get_metadata", struct {
+		Path string `json:"path"`
+	}{path}, &meta)
+	if err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// Delete removes the file at path
+func (c *Client) Delete(ctx context.Context, path string) error {
+	return c.rpc(ctx, "/2/files/delete_v2", struct {
+		Path string `json:"path"`
+	}{path}, nil)
+}
+
+// GetSpaceUsage returns how much of the user's dropbox is in use
+func (c *Client) GetSpaceUsage(ctx context.Context) (*SpaceUsage, error) {
+	var usage SpaceUsage
+	err := c.rpc(ctx, "/2/users/get_space_usage", nil, &usage)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (c *Client) uploadSession(ctx context.Context, commit commitInfo, r io.Reader) (*FileMetadata, error) {
+	buf := make([]byte, c.chunkSize())
+
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	var start sessionStartResult
+	err = c.content(ctx, "/2/files/upload_session/start", struct {
+		Close bool `json:"close"`
+	}{}, bytes.NewReader(buf[:n]), &start)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := sessionCursor{SessionID: start.SessionID, Offset: int64(n)}
+	for {
+		n, err = io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, err
+		}
+
+		if last {
+			var meta FileMetadata
+			err = c.content(ctx, "/2/files/upload_session/finish", struct {
+				Cursor sessionCursor `json:"cursor"`
+				Commit commitInfo    `json:"commit"`
+			}{cursor, commit}, bytes.NewReader(buf[:n]), &meta)
+			if err != nil {
+				return nil, err
+			}
+			return &meta, nil
+		}
+
+		err = c.content(ctx, "/2/files/upload_session/append_v2", struct {
+			Cursor sessionCursor `json:"cursor"`
+			Close  bool          `json:"close"`
+		}{Cursor: cursor}, bytes.NewReader(buf[:n]), nil)
+		if err != nil {
+			return nil, err
+		}
+		cursor.Offset += int64(n)
+	}
+}
+
+// content makes a request to a content endpoint, passing arg in the
+// Dropbox-API-Arg header and decoding the json response into out
+func (c *Client) content(ctx context.Context, endpoint string, arg interface{}, body io.Reader, out interface{}) error {
+	argJSON, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.ContentURL+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Dropbox-API-Arg", asciiJSON(argJSON))
+
+	return c.do(req, out)
+}
+
+// rpc makes a request to an rpc endpoint with arg as the json body
+func (c *Client) rpc(ctx context.Context, endpoint string, arg interface{}, out interface{}) error {
+	var body io.Reader
+	if arg != nil {
+		argJSON, err := json.Marshal(arg)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(argJSON)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.APIURL+endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if arg != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return c.do(req, out)
+}
+
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		if json.Unmarshal(bytes, &errResp) != nil || errResp.ErrorSummary == "" {
+			errResp.ErrorSummary = strings.TrimSpace(string(bytes))
+		}
+		return &APIError{StatusCode: resp.StatusCode, Summary: errResp.ErrorSummary}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(bytes, out)
+}
+
+func (c *Client) chunkSize() int64 {
+	if c.ChunkSize <= 0 || c.ChunkSize > maxSingleUpload {
+		return DefaultChunkSize
+	}
+	return c.ChunkSize
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// asciiJSON escapes non-ascii characters since http headers must be ascii
+func asciiJSON(b []byte) string {
+	var sb strings.Builder
+	for _, r := range string(b) {
+		if r < 0x80 {
+			sb.WriteRune(r)
+		} else if r > 0xFFFF {
+			r -= 0x10000
+			fmt.Fprintf(&sb, "\\u%04x\\u%04x", 0xD800+(r>>10), 0xDC00+(r&0x3FF))
+		} else {
+			fmt.Fprintf(&sb, "\\u%04x", r)
+		}
+	}
+	return sb.String()
+}
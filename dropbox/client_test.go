@@ -0,0 +1,237 @@
+package dropbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// fakeDropbox serves both the api and content endpoints, keeping an app folder
+// in memory. Folders are listed a page of pageSize files at a time.
+type fakeDropbox struct {
+	t        *testing.T
+	pageSize int
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	sessions map[string][]byte
+	requests []string
+}
+
+func newFakeDropbox(t *testing.T) *fakeDropbox {
+	return &fakeDropbox{t: t, pageSize: 1, files: map[string][]byte{}, sessions: map[string][]byte{}}
+}
+
+func (f *fakeDropbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.URL.Path)
+
+	if r.URL.Path == "/oauth2/token" {
+		r.ParseForm()
+		if r.PostForm.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh"}`)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer access" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Content endpoints take their argument in a header, rpc ones in the body
+	body, _ := ioutil.ReadAll(r.Body)
+	var arg struct {
+		Path   string
+		Cursor json.RawMessage
+		Commit commitInfo
+	}
+	if h := r.Header.Get("Dropbox-API-Arg"); h != "" {
+		json.Unmarshal([]byte(h), &arg)
+	} else {
+		json.Unmarshal(body, &arg)
+	}
+	var cursor sessionCursor
+	json.Unmarshal(arg.Cursor, &cursor)
+
+	switch r.URL.Path {
+	case "/2/files/upload":
+		f.files[arg.Path] = body
+		f.meta(w, arg.Path)
+	case "/2/files/upload_session/start":
+		id := fmt.Sprintf("session-%d", len(f.sessions)+1)
+		f.sessions[id] = body
+		fmt.Fprintf(w, `{"session_id":%q}`, id)
+	case "/2/files/upload_session/append_v2", "/2/files/upload_session/finish":
+		if int64(len(f.sessions[cursor.SessionID])) != cursor.Offset {
+			f.t.Errorf("%s at offset %d, session has %d bytes", r.URL.Path, cursor.Offset, len(f.sessions[cursor.SessionID]))
+		}
+		f.sessions[cursor.SessionID] = append(f.sessions[cursor.SessionID], body...)
+		if strings.HasSuffix(r.URL.Path, "finish") {
+			f.files[arg.Commit.Path] = f.sessions[cursor.SessionID]
+			f.meta(w, arg.Commit.Path)
+		} else {
+			fmt.Fprint(w, "null")
+		}
+	case "/2/files/list_folder", "/2/files/list_folder/continue":
+		var paths []string
+		for p := range f.files {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+
+		var start int
+		fmt.Sscan(strings.Trim(string(arg.Cursor), `"`), &start)
+		res := listFolderResult{Cursor: fmt.Sprint(start + f.pageSize), HasMore: start+f.pageSize < len(paths)}
+		for _, p := range paths[start:] {
+			if len(res.Entries) == f.pageSize {
+				break
+			}
+			res.Entries = append(res.Entries, f.metadata(p))
+		}
+		// Folders are listed too, without a rev
+		if start == 0 {
+			res.Entries = append(res.Entries, FileMetadata{Name: "folder"})
+		}
+		json.NewEncoder(w).Encode(res)
+	case "/2/files/get_metadata":
+		f.meta(w, arg.Path)
+	case "/2/files/delete_v2":
+		f.meta(w, arg.Path)
+		delete(f.files, arg.Path)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// meta answers with the metadata of path, or dropbox's error if it's missing
+func (f *fakeDropbox) meta(w http.ResponseWriter, path string) {
+	if _, ok := f.files[path]; !ok {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"error_summary":"path/not_found/..."}`)
+		return
+	}
+	json.NewEncoder(w).Encode(f.metadata(path))
+}
+
+func (f *fakeDropbox) metadata(path string) FileMetadata {
+	return FileMetadata{
+		Name:           strings.TrimPrefix(path, "/"),
+		PathDisplay:    path,
+		Size:           int64(len(f.files[path])),
+		ServerModified: time.Now().UTC(),
+		Rev:            "rev",
+	}
+}
+
+func TestDestination(t *testing.T) {
+	fake := newFakeDropbox(t)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	apiURL, contentURL := DefaultAPIURL, DefaultContentURL
+	DefaultAPIURL, DefaultContentURL = srv.URL, srv.URL
+	defer func() { DefaultAPIURL, DefaultContentURL = apiURL, contentURL }()
+
+	ctx := context.Background()
+	dest, err := storage.Open(ctx, &user.User{}, &user.Cloud{Name: Name, Token: "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.xml", "b.xml", "c.xml"} {
+		err = dest.Upload(ctx, name, strings.NewReader("backup "+name), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(fake.files["/b.xml"]) != "backup b.xml" {
+		t.Errorf("b.xml holds %q", fake.files["/b.xml"])
+	}
+
+	files, err := dest.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "a.xml,b.xml,c.xml" {
+		t.Errorf("List() = %v, want every file across the pages", names)
+	}
+
+	err = dest.Delete(ctx, "a.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.Delete(ctx, "a.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("deleting a missing file returned %v, want storage.ErrNotFound", err)
+	}
+	_, err = dest.Stat(ctx, "a.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("Stat() of a deleted file returned %v, want storage.ErrNotFound", err)
+	}
+}
+
+func TestUploadSession(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		size     int64
+		requests []string
+	}{
+		{
+			name:     "small file in one request",
+			data:     "0123",
+			size:     4,
+			requests: []string{"/2/files/upload"},
+		},
+		{
+			name:     "large file in chunks",
+			data:     "0123456789",
+			size:     10,
+			requests: []string{"/2/files/upload_session/start", "/2/files/upload_session/append_v2", "/2/files/upload_session/finish"},
+		},
+		{
+			name:     "unknown size ending on a chunk boundary",
+			data:     "01234567",
+			size:     -1,
+			requests: []string{"/2/files/upload_session/start", "/2/files/upload_session/append_v2", "/2/files/upload_session/finish"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDropbox(t)
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+
+			c := &Client{Token: "access", APIURL: srv.URL, ContentURL: srv.URL, ChunkSize: 4}
+			meta, err := c.Upload(context.Background(), "/backup.xml", strings.NewReader(tt.data), tt.size, UploadOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(fake.files["/backup.xml"]) != tt.data || meta.Size != int64(len(tt.data)) {
+				t.Errorf("uploaded %q, want %q", fake.files["/backup.xml"], tt.data)
+			}
+			if strings.Join(fake.requests, " ") != strings.Join(tt.requests, " ") {
+				t.Errorf("requests = %v, want %v", fake.requests, tt.requests)
+			}
+		})
+	}
+}
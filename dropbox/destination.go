@@ -0,0 +1,84 @@
+package dropbox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// Name is the cloud name dropbox destinations are registered under
+const Name = "Dropbox"
+
+func init() {
+	storage.Register(Name, open)
+}
+
+// destination stores backups in the root of the user's dropbox app folder
+type destination struct {
+	client *Client
+}
+
+func open(ctx context.Context, _ *user.User, c *user.Cloud) (storage.Destination, error) {
+	// Use the dropbox refresh token to retrieve an access token
+	accessToken, _, err := GetDropboxTokens(c.Token, "refresh_token")
+	if err != nil {
+		return nil, err
+	}
+	return &destination{client: NewClient(accessToken)}, nil
+}
+
+func (d *destination) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	_, err := d.client.Upload(ctx, "/"+name, r, size, UploadOptions{Mode: WriteModeOverwrite})
+	return err
+}
+
+func (d *destination) List(ctx context.Context) ([]storage.FileInfo, error) {
+	entries, err := d.client.ListFolder(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storage.FileInfo, 0, len(entries))
+	for i := range entries {
+		files = append(files, toFileInfo(&entries[i]))
+	}
+	return files, nil
+}
+
+func (d *destination) Delete(ctx context.Context, name string) error {
+	return notFound(d.client.Delete(ctx, "/"+name))
+}
+
+func (d *destination) Stat(ctx context.Context, name string) (*storage.FileInfo, error) {
+	meta, err := d.client.GetMetadata(ctx, "/"+name)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	fi := toFileInfo(meta)
+	return &fi, nil
+}
+
+func (d *destination) Quota(ctx context.Context) (*storage.Quota, error) {
+	usage, err := d.client.GetSpaceUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Quota{Used: usage.Used, Total: usage.Allocation.Allocated}, nil
+}
+
+func toFileInfo(meta *FileMetadata) storage.FileInfo {
+	return storage.FileInfo{Name: meta.Name, Size: meta.Size, Modified: meta.ServerModified}
+}
+
+// notFound translates dropbox's lookup errors into storage.ErrNotFound
+func notFound(err error) error {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && strings.Contains(apiErr.Summary, "not_found") {
+		return storage.ErrNotFound
+	}
+	return err
+}
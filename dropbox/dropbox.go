@@ -2,7 +2,6 @@ package dropbox
 
 import (
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -32,7 +31,7 @@ func GetDropboxTokens(code string, grantType string) (string, *user.Cloud, error
 
 	client := &http.Client{}
 
-	apiURL := "https://api.dropboxapi.com"
+	apiURL := DefaultAPIURL
 	resource := "/oauth2/token"
 	data := url.Values{}
 	data.Set("grant_type", grantType)
@@ -54,10 +53,8 @@ func GetDropboxTokens(code string, grantType string) (string, *user.Cloud, error
 	req.SetBasicAuth(clientID, clientSecret)
 
 	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		bytes, _ := ioutil.ReadAll(resp.Body)
-		log.Println(string(bytes))
-		return "", nil, errors.New("request to connect dropbox failed")
+	if err != nil {
+		return "", nil, err
 	}
 
 	defer resp.Body.Close()
@@ -68,6 +65,11 @@ func GetDropboxTokens(code string, grantType string) (string, *user.Cloud, error
 		return "", nil, err
 	}
 
+	if resp.StatusCode != 200 {
+		log.Println(string(bytes))
+		return "", nil, &APIError{StatusCode: resp.StatusCode, Summary: "request to connect dropbox failed"}
+	}
+
 	var dropboxResp dropboxResponse
 	json.Unmarshal(bytes, &dropboxResp)
 
@@ -79,7 +81,7 @@ func responseToCloud(resp *dropboxResponse) *user.Cloud {
 	token := resp.RefreshToken
 
 	return &user.Cloud{
-		Name:  "Dropbox",
+		Name:  Name,
 		Token: token,
 	}
 
@@ -0,0 +1,337 @@
+package gdrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/retry"
+)
+
+// DefaultBaseURL is the root of the google drive api, where clients send
+// requests unless told otherwise
+var DefaultBaseURL = "https://www.googleapis.com"
+
+const (
+	folderMimeType = "application/vnd.google-apps.folder"
+
+	// uploadGranularity is the multiple every resumable chunk but the last must be
+	uploadGranularity int64 = 256 << 10
+
+	// DefaultChunkSize is the size of each request in a resumable upload
+	DefaultChunkSize int64 = 32 * uploadGranularity
+)
+
+// ErrInvalidToken is returned when the access token is invalid or expired
+var ErrInvalidToken = errors.New("gdrive: invalid access token")
+
+// APIError describes an error response from the drive api
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gdrive: status %d: %s", e.StatusCode, e.Message)
+}
+
+// Is lets errors.Is match an APIError against ErrInvalidToken
+func (e *APIError) Is(target error) bool {
+	return target == ErrInvalidToken && e.StatusCode == http.StatusUnauthorized
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *APIError) Temporary() bool {
+	return retry.StatusTemporary(e.StatusCode)
+}
+
+// File is the subset of drive file metadata we care about
+type File struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	MimeType     string    `json:"mimeType,omitempty"`
+	Size         int64     `json:"size,string"`
+	ModifiedTime time.Time `json:"modifiedTime"`
+}
+
+// StorageQuota is the user's drive usage in bytes, Limit is 0 when unlimited
+type StorageQuota struct {
+	Limit int64 `json:"limit,string"`
+	Usage int64 `json:"usage,string"`
+}
+
+// Client talks to the drive api with a short-lived access token
+type Client struct {
+	Token      string
+	BaseURL    string
+	ChunkSize  int64
+	HTTPClient *http.Client
+}
+
+// NewClient creates a client for the real drive api
+func NewClient(token string) *Client {
+	return &Client{
+		Token:      token,
+		BaseURL:    DefaultBaseURL,
+		ChunkSize:  DefaultChunkSize,
+		HTTPClient: &http.Client{},
+	}
+}
+
+type fileList struct {
+	Files         []File `json:"files"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+type errorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// FindOrCreateFolder returns the id of the folder called name in the root of
+// the user's drive, creating it if it doesn't exist
+func (c *Client) FindOrCreateFolder(ctx context.Context, name string) (string, error) {
+	q := fmt.Sprintf("name = '%s' and mimeType = '%s' and 'root' in parents and trashed = false", escapeQuery(name), folderMimeType)
+	folders, err := c.ListFiles(ctx, q)
+	if err != nil {
+		return "", err
+	}
+	if len(folders) > 0 {
+		return folders[0].ID, nil
+	}
+
+	metadata, _ := json.Marshal(struct {
+		Name     string `json:"name"`
+		MimeType string `json:"mimeType"`
+	}{name, folderMimeType})
+
+	var folder File
+	err = c.do(ctx, http.MethodPost, c.BaseURL+"/drive/v3/files", bytes.NewReader(metadata), &folder)
+	if err != nil {
+		return "", err
+	}
+	return folder.ID, nil
+}
+
+// ListFiles returns every file matching the drive search query q
+func (c *Client) ListFiles(ctx context.Context, q string) ([]File, error) {
+	var files []File
+	pageToken := ""
+	for {
+		params := url.Values{}
+		params.Set("q", q)
+		params.Set("fields", "nextPageToken, files(id, name, mimeType, size, modifiedTime)")
+		params.Set("pageSize", "1000")
+		if pageToken != "" {
+			params.Set("pageToken", pageToken)
+		}
+
+		var list fileList
+		err := c.do(ctx, http.MethodGet, c.BaseURL+"/drive/v3/files?"+params.Encode(), nil, &list)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, list.Files...)
+
+		if list.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+// ListFolder returns the files inside the folder with the given id
+func (c *Client) ListFolder(ctx context.Context, folderID string) ([]File, error) {
+	q := fmt.Sprintf("'%s' in parents and mimeType != '%s' and trashed = false", escapeQuery(folderID), folderMimeType)
+	return c.ListFiles(ctx, q)
+}
+
+// FindFile returns the file called name inside a folder, or nil if there is none
+func (c *Client) FindFile(ctx context.Context, folderID string, name string) (*File, error) {
+	q := fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false", escapeQuery(name), escapeQuery(folderID))
+	files, err := c.ListFiles(ctx, q)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return &files[0], nil
+}
+
+// DeleteFile permanently removes the file with the given id
+func (c *Client) DeleteFile(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, c.BaseURL+"/drive/v3/files/"+url.PathEscape(id), nil, nil)
+}
+
+// GetStorageQuota returns how much of the user's drive is in use
+func (c *Client) GetStorageQuota(ctx context.Context) (*StorageQuota, error) {
+	var about struct {
+		StorageQuota StorageQuota `json:"storageQuota"`
+	}
+	err := c.do(ctx, http.MethodGet, c.BaseURL+"/drive/v3/about?fields=storageQuota", nil, &about)
+	if err != nil {
+		return nil, err
+	}
+	return &about.StorageQuota, nil
+}
+
+// Upload writes size bytes from r with a resumable upload, creating a new file
+// called name in the folder, or replacing the contents of existingID when set.
+// A negative size means unknown.
+func (c *Client) Upload(ctx context.Context, folderID string, existingID string, name string, r io.Reader, size int64) (*File, error) {
+	sessionURL, err := c.startResumable(ctx, folderID, existingID, name, size)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := c.chunkSize()
+	buf := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, err
+		}
+
+		total := "*"
+		if last {
+			total = strconv.FormatInt(offset+int64(n), 10)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, sessionURL, bytes.NewReader(buf[:n]))
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(n)-1, total))
+		} else {
+			req.Header.Set("Content-Range", "bytes */"+total)
+		}
+
+		var file File
+		resp, err := c.send(req, &file)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			return &file, nil
+		}
+		if last {
+			return nil, errors.New("gdrive: upload incomplete after final chunk")
+		}
+		offset += int64(n)
+	}
+}
+
+// startResumable opens a resumable upload session and returns its url
+func (c *Client) startResumable(ctx context.Context, folderID string, existingID string, name string, size int64) (string, error) {
+	method := http.MethodPost
+	endpoint := c.BaseURL + "/upload/drive/v3/files"
+	metadata := map[string]interface{}{"name": name}
+	if existingID != "" {
+		method = http.MethodPatch
+		endpoint += "/" + url.PathEscape(existingID)
+	} else {
+		metadata["parents"] = []string{folderID}
+	}
+	body, _ := json.Marshal(metadata)
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+"?uploadType=resumable&fields=id,name,size,modifiedTime", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/xml")
+	if size >= 0 {
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	resp, err := c.send(req, nil)
+	if err != nil {
+		return "", err
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("gdrive: resumable upload session has no location")
+	}
+	return location, nil
+}
+
+func (c *Client) do(ctx context.Context, method string, endpoint string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+
+	_, err = c.send(req, out)
+	return err
+}
+
+// send authorizes and sends req, treating 308 as success since that is how
+// drive acknowledges each chunk of a resumable upload
+func (c *Client) send(req *http.Request, out interface{}) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusPermanentRedirect {
+		return resp, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errResp errorResponse
+		if json.Unmarshal(data, &errResp) != nil || errResp.Error.Message == "" {
+			errResp.Error.Message = strings.TrimSpace(string(data))
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: errResp.Error.Message}
+	}
+
+	if out != nil && len(data) > 0 {
+		err = json.Unmarshal(data, out)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) chunkSize() int64 {
+	if c.ChunkSize < uploadGranularity {
+		return DefaultChunkSize
+	}
+	return c.ChunkSize - c.ChunkSize%uploadGranularity
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// escapeQuery escapes a value for use inside quotes in a drive search query
+func escapeQuery(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return strings.ReplaceAll(s, `'`, `\'`)
+}
@@ -0,0 +1,313 @@
+package gdrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+var (
+	queryName    = regexp.MustCompile(`name = '([^']*)'`)
+	queryParent  = regexp.MustCompile(`'([^']*)' in parents`)
+	queryFolders = regexp.MustCompile(`mimeType = '` + folderMimeType + `'`)
+	contentRange = regexp.MustCompile(`^bytes (?:(\d+)-(\d+)|\*)/(\d+|\*)$`)
+)
+
+// fakeDrive keeps a drive in memory, understanding just enough of the search
+// query language for the client's own queries. Files are listed a page of
+// pageSize at a time.
+type fakeDrive struct {
+	t        *testing.T
+	url      string
+	pageSize int
+
+	mu       sync.Mutex
+	ids      int
+	files    map[string]*fakeFile
+	sessions map[string]*fakeSession
+	ranges   []string
+}
+
+type fakeFile struct {
+	File
+	parent string
+	data   []byte
+}
+
+type fakeSession struct {
+	id     string
+	name   string
+	parent string
+	data   []byte
+}
+
+func newFakeDrive(t *testing.T) (*fakeDrive, *httptest.Server) {
+	f := &fakeDrive{t: t, pageSize: 2, files: map[string]*fakeFile{}, sessions: map[string]*fakeSession{}}
+	srv := httptest.NewServer(f)
+	f.url = srv.URL
+	return f, srv
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.URL.Path == "/token" {
+		fmt.Fprint(w, `{"access_token":"access","refresh_token":"refresh"}`)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer access" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"message":"Invalid Credentials"}}`)
+		return
+	}
+
+	var metadata struct {
+		Name     string
+		MimeType string
+		Parents  []string
+	}
+	json.Unmarshal(body, &metadata)
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/drive/v3/files":
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodPost && r.URL.Path == "/drive/v3/files":
+		file := f.create(metadata.Name, "root", nil)
+		file.MimeType = metadata.MimeType
+		json.NewEncoder(w).Encode(file.File)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/drive/v3/files/"):
+		id := strings.TrimPrefix(r.URL.Path, "/drive/v3/files/")
+		if f.files[id] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, id)
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/upload/drive/v3/files"):
+		if r.URL.Query().Get("uploadType") != "resumable" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s := &fakeSession{id: strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/upload/drive/v3/files"), "/"), name: metadata.Name}
+		if len(metadata.Parents) > 0 {
+			s.parent = metadata.Parents[0]
+		}
+		id := fmt.Sprintf("session-%d", len(f.sessions)+1)
+		f.sessions[id] = s
+		w.Header().Set("Location", f.url+"/sessions/"+id)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/sessions/"):
+		f.upload(w, f.sessions[strings.TrimPrefix(r.URL.Path, "/sessions/")], r.Header.Get("Content-Range"), body)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeDrive) list(w http.ResponseWriter, params url.Values) {
+	q := params.Get("q")
+	var matches []File
+	for _, file := range f.files {
+		if m := queryName.FindStringSubmatch(q); m != nil && m[1] != file.Name {
+			continue
+		}
+		if m := queryParent.FindStringSubmatch(q); m != nil && m[1] != file.parent {
+			continue
+		}
+		if queryFolders.MatchString(q) != (file.MimeType == folderMimeType) {
+			continue
+		}
+		matches = append(matches, file.File)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Name < matches[j].Name })
+
+	start, _ := strconv.Atoi(params.Get("pageToken"))
+	var list fileList
+	for i := start; i < len(matches) && i < start+f.pageSize; i++ {
+		list.Files = append(list.Files, matches[i])
+	}
+	if start+f.pageSize < len(matches) {
+		list.NextPageToken = strconv.Itoa(start + f.pageSize)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func (f *fakeDrive) create(name string, parent string, data []byte) *fakeFile {
+	f.ids++
+	file := &fakeFile{File: File{ID: fmt.Sprintf("file-%d", f.ids), Name: name}, parent: parent}
+	f.files[file.ID] = file
+	f.write(file, data)
+	return file
+}
+
+func (f *fakeDrive) write(file *fakeFile, data []byte) {
+	file.data = data
+	file.Size = int64(len(data))
+	file.ModifiedTime = time.Now().UTC()
+}
+
+// upload takes one chunk of a resumable upload, answering 308 until the
+// total has been received
+func (f *fakeDrive) upload(w http.ResponseWriter, s *fakeSession, header string, chunk []byte) {
+	f.ranges = append(f.ranges, header)
+	m := contentRange.FindStringSubmatch(header)
+	if s == nil || m == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if m[1] != "" {
+		first, _ := strconv.Atoi(m[1])
+		last, _ := strconv.Atoi(m[2])
+		if first != len(s.data) || last-first+1 != len(chunk) {
+			f.t.Errorf("chunk %s doesn't follow the %d bytes received", header, len(s.data))
+		}
+	}
+	s.data = append(s.data, chunk...)
+
+	if m[3] == "*" || m[3] != strconv.Itoa(len(s.data)) {
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	file := f.files[s.id]
+	if file == nil {
+		file = f.create(s.name, s.parent, s.data)
+	} else {
+		f.write(file, s.data)
+	}
+	json.NewEncoder(w).Encode(file.File)
+}
+
+func TestDestination(t *testing.T) {
+	fake, srv := newFakeDrive(t)
+	defer srv.Close()
+
+	baseURL, tokenURL := DefaultBaseURL, TokenURL
+	DefaultBaseURL, TokenURL = srv.URL, srv.URL+"/token"
+	defer func() { DefaultBaseURL, TokenURL = baseURL, tokenURL }()
+
+	ctx := context.Background()
+	dest, err := storage.Open(ctx, &user.User{}, &user.Cloud{Name: Name, Token: "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.xml", "b.xml", "c.xml"} {
+		err = dest.Upload(ctx, name, strings.NewReader("backup "+name), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Uploading an existing name replaces its contents rather than adding a copy
+	err = dest.Upload(ctx, "b.xml", strings.NewReader("replaced"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := dest.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "a.xml,b.xml,c.xml" {
+		t.Errorf("List() = %v, want the three backups but not the folder", names)
+	}
+	if files[1].Size != 8 {
+		t.Errorf("b.xml is %d bytes, want the 8 it was replaced with", files[1].Size)
+	}
+
+	err = dest.Delete(ctx, "a.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.Delete(ctx, "a.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("deleting a missing file returned %v, want storage.ErrNotFound", err)
+	}
+	_, err = dest.Stat(ctx, "a.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("Stat() of a deleted file returned %v, want storage.ErrNotFound", err)
+	}
+	if len(fake.files) != 3 {
+		t.Errorf("drive holds %d files, want the folder and two backups", len(fake.files))
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	chunk := int(uploadGranularity)
+	tests := []struct {
+		name   string
+		size   int
+		known  bool
+		ranges []string
+	}{
+		{
+			name:   "one short chunk",
+			size:   10,
+			known:  true,
+			ranges: []string{"bytes 0-9/10"},
+		},
+		{
+			name:  "last chunk short",
+			size:  2*chunk + 10,
+			known: true,
+			ranges: []string{
+				fmt.Sprintf("bytes 0-%d/*", chunk-1),
+				fmt.Sprintf("bytes %d-%d/*", chunk, 2*chunk-1),
+				fmt.Sprintf("bytes %d-%d/%d", 2*chunk, 2*chunk+9, 2*chunk+10),
+			},
+		},
+		{
+			// Nothing is left for the last request, which just gives the total
+			name: "unknown size ending on a chunk boundary",
+			size: 2 * chunk,
+			ranges: []string{
+				fmt.Sprintf("bytes 0-%d/*", chunk-1),
+				fmt.Sprintf("bytes %d-%d/*", chunk, 2*chunk-1),
+				fmt.Sprintf("bytes */%d", 2*chunk),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeDrive(t)
+			defer srv.Close()
+
+			data := bytes.Repeat([]byte("x"), tt.size)
+			size := int64(-1)
+			if tt.known {
+				size = int64(tt.size)
+			}
+
+			c := &Client{Token: "access", BaseURL: srv.URL, ChunkSize: uploadGranularity}
+			file, err := c.Upload(context.Background(), "folder", "", "backup.xml", bytes.NewReader(data), size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.Size != int64(tt.size) || !bytes.Equal(fake.files[file.ID].data, data) {
+				t.Errorf("uploaded %d bytes, want %d", file.Size, tt.size)
+			}
+			if strings.Join(fake.ranges, ", ") != strings.Join(tt.ranges, ", ") {
+				t.Errorf("Content-Range headers = %v, want %v", fake.ranges, tt.ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package gdrive
+
+import (
+	"context"
+	"io"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// Name is the cloud name google drive destinations are registered under
+const Name = "Google Drive"
+
+// DefaultFolder is the drive folder backups go in when the user doesn't pick one
+const DefaultFolder = "ToodleBackup"
+
+func init() {
+	storage.Register(Name, open)
+}
+
+// Connect exchanges an authorization code for a refresh token and makes
+// sure the target folder exists, returning the cloud to store for the user
+func Connect(ctx context.Context, code string, folder string) (*user.Cloud, error) {
+	if folder == "" {
+		folder = DefaultFolder
+	}
+
+	accessToken, cloud, err := GetGoogleTokens(code, "authorization_code")
+	if err != nil {
+		return nil, err
+	}
+
+	folderID, err := NewClient(accessToken).FindOrCreateFolder(ctx, folder)
+	if err != nil {
+		return nil, err
+	}
+
+	cloud.Config = map[string]string{"folder": folder, "folderId": folderID}
+	return cloud, nil
+}
+
+// destination stores backups in a single folder of the user's drive
+type destination struct {
+	client   *Client
+	folderID string
+}
+
+func open(ctx context.Context, _ *user.User, c *user.Cloud) (storage.Destination, error) {
+	// Use the google refresh token to retrieve an access token
+	accessToken, _, err := GetGoogleTokens(c.Token, "refresh_token")
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewClient(accessToken)
+	folderID := c.Config["folderId"]
+	if folderID == "" {
+		folder := c.Config["folder"]
+		if folder == "" {
+			folder = DefaultFolder
+		}
+		folderID, err = client.FindOrCreateFolder(ctx, folder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &destination{client: client, folderID: folderID}, nil
+}
+
+func (d *destination) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	existing, err := d.client.FindFile(ctx, d.folderID, name)
+	if err != nil {
+		return err
+	}
+
+	existingID := ""
+	if existing != nil {
+		existingID = existing.ID
+	}
+
+	_, err = d.client.Upload(ctx, d.folderID, existingID, name, r, size)
+	return err
+}
+
+func (d *destination) List(ctx context.Context) ([]storage.FileInfo, error) {
+	driveFiles, err := d.client.ListFolder(ctx, d.folderID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storage.FileInfo, 0, len(driveFiles))
+	for _, f := range driveFiles {
+		files = append(files, storage.FileInfo{Name: f.Name, Size: f.Size, Modified: f.ModifiedTime})
+	}
+	return files, nil
+}
+
+func (d *destination) Delete(ctx context.Context, name string) error {
+	f, err := d.client.FindFile(ctx, d.folderID, name)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return storage.ErrNotFound
+	}
+	return d.client.DeleteFile(ctx, f.ID)
+}
+
+func (d *destination) Stat(ctx context.Context, name string) (*storage.FileInfo, error) {
+	f, err := d.client.FindFile(ctx, d.folderID, name)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, storage.ErrNotFound
+	}
+	return &storage.FileInfo{Name: f.Name, Size: f.Size, Modified: f.ModifiedTime}, nil
+}
+
+func (d *destination) Quota(ctx context.Context) (*storage.Quota, error) {
+	quota, err := d.client.GetStorageQuota(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Quota{Used: quota.Usage, Total: quota.Limit}, nil
+}
@@ -0,0 +1,86 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// TokenURL is google's oauth token endpoint, overridable for testing
+var TokenURL = "https://oauth2.googleapis.com/token"
+
+type googleResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	Scope        string `json:"scope"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// GetGoogleTokens gets access and refresh tokens from google
+func GetGoogleTokens(code string, grantType string) (string, *user.Cloud, error) {
+
+	clientID := os.Getenv("GOOGLECLIENTID")
+	clientSecret := os.Getenv("GOOGLESECRET")
+
+	client := &http.Client{}
+
+	data := url.Values{}
+	data.Set("grant_type", grantType)
+	data.Set("client_id", clientID)
+	data.Set("client_secret", clientSecret)
+	if grantType == "authorization_code" {
+		data.Set("redirect_uri", "https://toodlebackup.com/googleredirect")
+		data.Set("code", code)
+	} else if grantType == "refresh_token" {
+		data.Set("refresh_token", code)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, TokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer resp.Body.Close()
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		log.Println(string(bytes))
+		return "", nil, &APIError{StatusCode: resp.StatusCode, Message: "request to connect google drive failed"}
+	}
+
+	var googleResp googleResponse
+	json.Unmarshal(bytes, &googleResp)
+
+	return googleResp.AccessToken, responseToCloud(&googleResp), nil
+}
+
+func responseToCloud(resp *googleResponse) *user.Cloud {
+
+	token := resp.RefreshToken
+
+	return &user.Cloud{
+		Name:  Name,
+		Token: token,
+	}
+
+}
@@ -1,23 +1,40 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/jarota/ToodleBackupBackend/auth"
+	"github.com/jarota/ToodleBackupBackend/cron"
 	"github.com/jarota/ToodleBackupBackend/db"
 	"github.com/jarota/ToodleBackupBackend/dropbox"
+	"github.com/jarota/ToodleBackupBackend/gdrive"
+	"github.com/jarota/ToodleBackupBackend/history"
+	"github.com/jarota/ToodleBackupBackend/jobs"
+	"github.com/jarota/ToodleBackupBackend/limits"
+	"github.com/jarota/ToodleBackupBackend/onedrive"
 	"github.com/jarota/ToodleBackupBackend/random"
+	"github.com/jarota/ToodleBackupBackend/s3"
 	"github.com/jarota/ToodleBackupBackend/scheduler"
+	"github.com/jarota/ToodleBackupBackend/sftp"
 	"github.com/jarota/ToodleBackupBackend/toodledo"
 	"github.com/jarota/ToodleBackupBackend/user"
+	"github.com/jarota/ToodleBackupBackend/webdav"
 )
 
 type credentials struct {
@@ -29,11 +46,29 @@ type code struct {
 	Value string `json:"value"`
 }
 
+type retentionSettings struct {
+	Cloud string `json:"cloud"`
+	user.Retention
+}
+
+type folderCode struct {
+	Value  string `json:"value"`
+	Folder string `json:"folder"`
+}
+
 const (
 	dbName string = "ToodleBackup"
 	users  string = "Users"
 )
 
+// eventsPing is how long a backup's events can go quiet before a comment is
+// sent to check the client is still there
+const eventsPing = 5 * time.Second
+
+// needFullBackup makes the user's next backup a full one, for when toodledo or
+// a new cloud is connected and there is nothing for a delta to build on
+var needFullBackup = bson.E{Key: "$unset", Value: bson.D{{Key: "lastfull", Value: ""}}}
+
 // HelloWorld handler for basic testing
 func HelloWorld(_ mongo.Client) handler {
 	return func(c *fiber.Ctx) error {
@@ -80,6 +115,7 @@ func Register(dbc *mongo.Client) handler {
 		}
 
 		u := user.New(creds.Username, hash)
+		u.NextRun = scheduler.NextRun(u, time.Now())
 
 		_, err = userCollection.InsertOne(ctx, u)
 		if err != nil {
@@ -218,6 +254,7 @@ func ConnToodledo(dbc *mongo.Client) handler {
 			{Key: "$set", Value: bson.D{
 				{Key: "toodledo", Value: *toodleInfo},
 			}},
+			needFullBackup,
 		}
 		_, err = userCollection.UpdateOne(ctx, filter, update)
 		if err != nil {
@@ -255,6 +292,7 @@ func ConnDropbox(dbc *mongo.Client) handler {
 			{Key: "$push", Value: bson.D{
 				{Key: "clouds", Value: dropboxInfo},
 			}},
+			needFullBackup,
 		}
 		_, err = userCollection.UpdateOne(ctx, filter, update)
 		if err != nil {
@@ -267,12 +305,22 @@ func ConnDropbox(dbc *mongo.Client) handler {
 	}
 }
 
-// SetBackupFrequency handler for setting/updating user's frequency in the db
-func SetBackupFrequency(dbc *mongo.Client) handler {
+// ConnS3 handler for adding an s3 compatible bucket to the user's clouds
+func ConnS3(dbc *mongo.Client) handler {
 	ctx := context.Background()
 	return func(c *fiber.Ctx) error {
-		var freq string
-		json.Unmarshal([]byte(c.Body()), &freq)
+		var cfg s3.Config
+		err := json.Unmarshal([]byte(c.Body()), &cfg)
+		if err != nil {
+			c.SendStatus(fiber.StatusBadRequest)
+			return err
+		}
+
+		s3Info, err := s3.Connect(ctx, &cfg)
+		if err != nil {
+			c.SendStatus(fiber.StatusUnauthorized)
+			return err
+		}
 
 		userCollection, err := db.GetCollection(dbc, dbName, users)
 		if err != nil {
@@ -283,28 +331,231 @@ func SetBackupFrequency(dbc *mongo.Client) handler {
 		name := getAuthenticatedUsername(c)
 		filter := bson.D{{Key: "username", Value: name}}
 		update := bson.D{
-			{Key: "$set", Value: bson.D{
-				{Key: "frequency", Value: freq},
+			{Key: "$push", Value: bson.D{
+				{Key: "clouds", Value: s3Info},
+			}},
+			needFullBackup,
+		}
+		_, err = userCollection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		c.SendStatus(201) // Cloud service successfully added
+		return nil
+	}
+}
+
+// ConnGoogleDrive handler for exchanging a google auth code and adding drive to the user's clouds
+func ConnGoogleDrive(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		var code folderCode
+		json.Unmarshal([]byte(c.Body()), &code)
+
+		driveInfo, err := gdrive.Connect(ctx, code.Value, code.Folder)
+		if err != nil {
+			c.SendStatus(fiber.StatusUnauthorized)
+			return err
+		}
+
+		userCollection, err := db.GetCollection(dbc, dbName, users)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		name := getAuthenticatedUsername(c)
+		filter := bson.D{{Key: "username", Value: name}}
+		update := bson.D{
+			{Key: "$push", Value: bson.D{
+				{Key: "clouds", Value: driveInfo},
+			}},
+			needFullBackup,
+		}
+		_, err = userCollection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		c.SendStatus(201) // Cloud service successfully added
+		return nil
+	}
+}
+
+// ConnOneDrive handler for exchanging a microsoft auth code and adding onedrive to the user's clouds
+func ConnOneDrive(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		var code code
+		json.Unmarshal([]byte(c.Body()), &code)
+
+		oneDriveInfo, err := onedrive.Connect(ctx, code.Value)
+		if err != nil {
+			c.SendStatus(fiber.StatusUnauthorized)
+			return err
+		}
+
+		userCollection, err := db.GetCollection(dbc, dbName, users)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		name := getAuthenticatedUsername(c)
+		filter := bson.D{{Key: "username", Value: name}}
+		update := bson.D{
+			{Key: "$push", Value: bson.D{
+				{Key: "clouds", Value: oneDriveInfo},
+			}},
+			needFullBackup,
+		}
+		_, err = userCollection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		c.SendStatus(201) // Cloud service successfully added
+		return nil
+	}
+}
+
+// ConnWebDAV handler for adding a webdav server, such as nextcloud, to the user's clouds
+func ConnWebDAV(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		var cfg webdav.Config
+		err := json.Unmarshal([]byte(c.Body()), &cfg)
+		if err != nil {
+			c.SendStatus(fiber.StatusBadRequest)
+			return err
+		}
+
+		davInfo, err := webdav.Connect(ctx, &cfg)
+		if err != nil {
+			c.SendStatus(fiber.StatusUnauthorized)
+			return err
+		}
+
+		userCollection, err := db.GetCollection(dbc, dbName, users)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		name := getAuthenticatedUsername(c)
+		filter := bson.D{{Key: "username", Value: name}}
+		update := bson.D{
+			{Key: "$push", Value: bson.D{
+				{Key: "clouds", Value: davInfo},
 			}},
+			needFullBackup,
+		}
+		_, err = userCollection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
 		}
 
+		c.SendStatus(201) // Cloud service successfully added
+		return nil
+	}
+}
+
+// ConnSFTP handler for adding an sftp server to the user's clouds
+func ConnSFTP(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		var cfg sftp.Config
+		err := json.Unmarshal([]byte(c.Body()), &cfg)
+		if err != nil {
+			c.SendStatus(fiber.StatusBadRequest)
+			return err
+		}
+
+		sftpInfo, err := sftp.Connect(ctx, &cfg)
+		if err != nil {
+			c.SendStatus(fiber.StatusUnauthorized)
+			return err
+		}
+
+		userCollection, err := db.GetCollection(dbc, dbName, users)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		name := getAuthenticatedUsername(c)
+		filter := bson.D{{Key: "username", Value: name}}
+		update := bson.D{
+			{Key: "$push", Value: bson.D{
+				{Key: "clouds", Value: sftpInfo},
+			}},
+			needFullBackup,
+		}
 		_, err = userCollection.UpdateOne(ctx, filter, update)
 		if err != nil {
 			c.SendStatus(fiber.StatusInternalServerError)
 			return err
 		}
 
+		c.SendStatus(201) // Cloud service successfully added
+		return nil
+	}
+}
+
+// SetBackupFrequency handler for setting/updating user's frequency in the db
+func SetBackupFrequency(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		var freq user.Frequency
+		json.Unmarshal([]byte(c.Body()), &freq)
+		if !freq.Valid() {
+			c.Status(fiber.StatusBadRequest).Send([]byte("Frequency must be hourly, daily, weekly or monthly"))
+			return nil
+		}
+
+		userCollection, err := db.GetCollection(dbc, dbName, users)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		name := getAuthenticatedUsername(c)
+		filter := bson.D{{Key: "username", Value: name}}
+
+		var u user.User
+		err = userCollection.FindOne(ctx, filter).Decode(&u)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+		u.Frequency = freq
+
+		err = saveSchedule(ctx, userCollection, &u, bson.D{{Key: "frequency", Value: freq}})
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
 		c.SendStatus(201) // Backup frequency successfully set
 		return nil
 	}
 }
 
-// SetBackupTime sets the backuptime for the authenticated user
+// SetBackupTime sets the backuptime for the authenticated user, in their timezone
 func SetBackupTime(dbc *mongo.Client) handler {
 	ctx := context.Background()
 	return func(c *fiber.Ctx) error {
 		var t user.BackupTime
 		json.Unmarshal([]byte(c.Body()), &t)
+		if !t.Valid() {
+			c.Status(fiber.StatusBadRequest).Send([]byte("Backup time out of range"))
+			return nil
+		}
 
 		userCollection, err := db.GetCollection(dbc, dbName, users)
 		if err != nil {
@@ -314,12 +565,16 @@ func SetBackupTime(dbc *mongo.Client) handler {
 
 		name := getAuthenticatedUsername(c)
 		filter := bson.D{{Key: "username", Value: name}}
-		update := bson.D{
-			{Key: "$set", Value: bson.D{
-				{Key: "time", Value: t},
-			}},
+
+		var u user.User
+		err = userCollection.FindOne(ctx, filter).Decode(&u)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
 		}
-		_, err = userCollection.UpdateOne(ctx, filter, update)
+		u.Time = t
+
+		err = saveSchedule(ctx, userCollection, &u, bson.D{{Key: "time", Value: t}})
 		if err != nil {
 			c.SendStatus(fiber.StatusInternalServerError)
 			return err
@@ -330,15 +585,81 @@ func SetBackupTime(dbc *mongo.Client) handler {
 	}
 }
 
-// BackupUser is an explicit call to the backup function
-func BackupUser(dbc *mongo.Client) handler {
+// SetBackupCron sets a cron expression to back the authenticated user up on,
+// an empty expression goes back to their frequency and backup time
+func SetBackupCron(dbc *mongo.Client) handler {
 	ctx := context.Background()
 	return func(c *fiber.Ctx) error {
+		var expr string
+		err := json.Unmarshal([]byte(c.Body()), &expr)
+		if err != nil {
+			c.SendStatus(fiber.StatusBadRequest)
+			return err
+		}
+		expr = strings.Join(strings.Fields(expr), " ")
+		if expr != "" {
+			_, err = cron.Parse(expr)
+			if err != nil {
+				c.Status(fiber.StatusBadRequest).Send([]byte(err.Error()))
+				return nil
+			}
+		}
+
 		userCollection, err := db.GetCollection(dbc, dbName, users)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		name := getAuthenticatedUsername(c)
+		filter := bson.D{{Key: "username", Value: name}}
+
+		var u user.User
+		err = userCollection.FindOne(ctx, filter).Decode(&u)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+		u.Cron = expr
+
+		err = saveSchedule(ctx, userCollection, &u, bson.D{{Key: "cron", Value: expr}})
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		c.SendStatus(201) // Backup cron successfully set
+		return nil
+	}
+}
+
+// SetTimezone sets the IANA timezone, such as "America/New_York", that the
+// authenticated user's backup time is in
+func SetTimezone(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		var tz string
+		err := json.Unmarshal([]byte(c.Body()), &tz)
 		if err != nil {
 			c.SendStatus(fiber.StatusBadRequest)
 			return err
 		}
+		// LoadLocation treats an empty name as UTC and "Local" as the server's zone
+		if tz == "" || tz == "Local" {
+			c.Status(fiber.StatusBadRequest).Send([]byte("Unknown timezone"))
+			return nil
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest).Send([]byte("Unknown timezone"))
+			return nil
+		}
+
+		userCollection, err := db.GetCollection(dbc, dbName, users)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
 
 		name := getAuthenticatedUsername(c)
 		filter := bson.D{{Key: "username", Value: name}}
@@ -349,10 +670,250 @@ func BackupUser(dbc *mongo.Client) handler {
 			c.SendStatus(fiber.StatusInternalServerError)
 			return err
 		}
+		u.Timezone = loc.String()
+
+		err = saveSchedule(ctx, userCollection, &u, bson.D{{Key: "timezone", Value: u.Timezone}})
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		c.SendStatus(201) // Timezone successfully set
+		return nil
+	}
+}
+
+// saveSchedule sets the changed schedule fields along with the next run they produce
+func saveSchedule(ctx context.Context, userCollection *mongo.Collection, u *user.User, fields bson.D) error {
+	fields = append(fields, bson.E{Key: "nextrun", Value: scheduler.NextRun(u, time.Now())})
+
+	filter := bson.D{{Key: "username", Value: u.Username}}
+	update := bson.D{{Key: "$set", Value: fields}}
+	_, err := userCollection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// SetRetention sets how many old backups to keep, for a single cloud when one is named
+// and otherwise for every cloud without its own policy
+func SetRetention(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		var r retentionSettings
+		err := json.Unmarshal([]byte(c.Body()), &r)
+		if err != nil {
+			c.SendStatus(fiber.StatusBadRequest)
+			return err
+		}
+		if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 {
+			c.Status(fiber.StatusBadRequest).Send([]byte("Retention rules cannot be negative"))
+			return nil
+		}
+
+		userCollection, err := db.GetCollection(dbc, dbName, users)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		name := getAuthenticatedUsername(c)
+		filter := bson.D{{Key: "username", Value: name}}
+		update := bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "retention", Value: r.Retention},
+			}},
+		}
+		opts := options.Update()
+		if r.Cloud != "" {
+			filter = append(filter, bson.E{Key: "clouds.name", Value: r.Cloud})
+			update = bson.D{
+				{Key: "$set", Value: bson.D{
+					{Key: "clouds.$[c].retention", Value: r.Retention},
+				}},
+			}
+			opts.SetArrayFilters(options.ArrayFilters{
+				Filters: []interface{}{bson.D{{Key: "c.name", Value: r.Cloud}}},
+			})
+		}
+
+		res, err := userCollection.UpdateOne(ctx, filter, update, opts)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+		if res.MatchedCount == 0 {
+			c.Status(fiber.StatusNotFound).Send([]byte("Cloud not connected"))
+			return nil
+		}
+
+		c.SendStatus(201) // Retention policy successfully set
+		return nil
+	}
+}
+
+// BackupUser is an explicit call to the backup function, it queues a backup
+// and returns the job straight away so its progress can be followed
+func BackupUser(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		name := getAuthenticatedUsername(c)
+
+		job, err := jobs.Enqueue(ctx, dbc, name, history.TriggerManual)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		c.Status(fiber.StatusAccepted).JSON(job) // User backup queued
+		return nil
+	}
+}
 
-		scheduler.BackupUserData(ctx, dbc, &u)
+// GetBackup handler for the status of one of the authenticated user's backup jobs
+func GetBackup(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		job, err := findJob(ctx, dbc, c)
+		if job == nil {
+			return err
+		}
+
+		c.JSON(job)
+		return nil
+	}
+}
+
+// BackupEvents handler for following a backup job's progress with server-sent
+// events. A progress event is sent whenever the job changes, and the stream
+// ends once the job is done or has failed. A comment is sent every few seconds
+// in between, so the stream stops soon after the client goes away.
+func BackupEvents(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		job, err := findJob(ctx, dbc, c)
+		if job == nil {
+			return err
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			var last []byte
+			lastSent := time.Now()
+			for {
+				data, err := json.Marshal(job)
+				if err != nil {
+					return
+				}
+				sent := true
+				if !bytes.Equal(data, last) {
+					fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+					last = data
+				} else if time.Since(lastSent) >= eventsPing {
+					fmt.Fprint(w, ": ping\n\n")
+				} else {
+					sent = false
+				}
+				if sent {
+					// Flush fails once the client has gone away
+					if w.Flush() != nil {
+						return
+					}
+					lastSent = time.Now()
+				}
+				if job.Status == jobs.StatusDone || job.Status == jobs.StatusFailed {
+					return
+				}
+
+				time.Sleep(time.Second)
+				job, err = jobs.Get(ctx, dbc, job.ID)
+				if err != nil {
+					log.Printf("Error following backup job: %v\n", err)
+					return
+				}
+			}
+		})
+		return nil
+	}
+}
+
+// findJob looks up the job named by the id parameter, as long as it belongs to
+// the authenticated user. If it can't, the response is sent and the job is nil.
+func findJob(ctx context.Context, dbc *mongo.Client, c *fiber.Ctx) (*jobs.Job, error) {
+	id, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return nil, nil
+	}
+
+	job, err := jobs.Get(ctx, dbc, id)
+	if err == mongo.ErrNoDocuments || (err == nil && job.Username != getAuthenticatedUsername(c)) {
+		c.SendStatus(fiber.StatusNotFound)
+		return nil, nil
+	}
+	if err != nil {
+		c.SendStatus(fiber.StatusInternalServerError)
+		return nil, err
+	}
+	return job, nil
+}
+
+// GetBackups handler for paging through the authenticated user's backup history,
+// newest first, with the page and limit query parameters
+func GetBackups(dbc *mongo.Client) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		page, err := strconv.ParseInt(c.Query("page", "1"), 10, 64)
+		if err != nil || page < 1 {
+			c.Status(fiber.StatusBadRequest).Send([]byte("Invalid page"))
+			return nil
+		}
+		limit, err := strconv.ParseInt(c.Query("limit", "20"), 10, 64)
+		if err != nil || limit < 1 || limit > 100 {
+			c.Status(fiber.StatusBadRequest).Send([]byte("Limit must be between 1 and 100"))
+			return nil
+		}
+
+		name := getAuthenticatedUsername(c)
+		runs, total, err := history.List(ctx, dbc, name, page, limit)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
+
+		c.JSON(fiber.Map{"runs": runs, "total": total, "page": page, "limit": limit})
+		return nil
+	}
+}
+
+// Metrics handler for reporting how busy the backup queue, workers and
+// upstream services are. Requests must send token as a bearer token, and
+// there are no metrics without one.
+func Metrics(dbc *mongo.Client, pool *jobs.Pool, token string) handler {
+	ctx := context.Background()
+	return func(c *fiber.Ctx) error {
+		if token == "" {
+			c.SendStatus(fiber.StatusNotFound)
+			return nil
+		}
+		sent := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			c.SendStatus(fiber.StatusUnauthorized)
+			return nil
+		}
+
+		queue, err := jobs.Stats(ctx, dbc)
+		if err != nil {
+			c.SendStatus(fiber.StatusInternalServerError)
+			return err
+		}
 
-		c.SendStatus(200) // User backup complete
+		c.JSON(fiber.Map{
+			"queue":     queue,
+			"workers":   pool.Stats(),
+			"upstreams": limits.Default.Stats(),
+		})
 		return nil
 	}
 }
@@ -0,0 +1,181 @@
+package history
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jarota/ToodleBackupBackend/db"
+)
+
+const (
+	dbName string = "ToodleBackup"
+	runs   string = "BackupRuns"
+)
+
+// Trigger describes what started a backup run
+type Trigger string
+
+// Triggers for backup runs
+const (
+	TriggerScheduled Trigger = "scheduled"
+	TriggerManual    Trigger = "manual"
+)
+
+// Kind is what a run backed up
+type Kind string
+
+// Kinds of run, a delta only holds what changed since the previous backup and
+// a run is skipped when nothing has
+const (
+	KindFull    Kind = "full"
+	KindDelta   Kind = "delta"
+	KindSkipped Kind = "skipped"
+)
+
+// DestinationResult is the outcome of uploading a backup to one cloud
+type DestinationResult struct {
+	Cloud  string `json:"cloud"`
+	Pruned int    `json:"pruned"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Deletion records an item being deleted in toodledo, such as a task
+type Deletion struct {
+	Scope   string    `json:"scope"`
+	ID      int64     `json:"id"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// MaxDeletions is how many deletions a run holds. A first backup can find
+// years of them, which only the backup file keeps in full.
+const MaxDeletions = 100
+
+// Run records a single attempt at backing up a user's data. Counts holds the
+// number of items backed up for each toodledo scope, and Totals how many
+// toodledo said there were for scopes it pages through, so a backup that
+// missed items can be spotted. Deletions are the newest of the items deleted
+// since the previous backup, and DeletionCount how many there were in all.
+type Run struct {
+	ID            primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Username      string              `json:"username"`
+	Trigger       Trigger             `json:"trigger"`
+	Kind          Kind                `json:"kind"`
+	Started       time.Time           `json:"started"`
+	Finished      time.Time           `json:"finished"`
+	Counts        map[string]int      `json:"counts"`
+	Totals        map[string]int      `json:"totals"`
+	Deletions     []Deletion          `json:"deletions,omitempty"`
+	DeletionCount int                 `json:"deletionCount"`
+	Bytes         int64               `json:"bytes"`
+	Destinations  []DestinationResult `json:"destinations"`
+	Error         string              `json:"error,omitempty"`
+}
+
+// AddDeletions records items deleted since the previous backup, keeping only
+// the newest MaxDeletions
+func (r *Run) AddDeletions(ds []Deletion) {
+	r.DeletionCount += len(ds)
+	r.Deletions = append(r.Deletions, ds...)
+	sort.SliceStable(r.Deletions, func(i, j int) bool {
+		return r.Deletions[i].Deleted.After(r.Deletions[j].Deleted)
+	})
+	if len(r.Deletions) > MaxDeletions {
+		r.Deletions = append([]Deletion(nil), r.Deletions[:MaxDeletions]...)
+	}
+}
+
+// EnsureIndexes creates the indexes used to page through a user's history
+func EnsureIndexes(ctx context.Context, dbc *mongo.Client) error {
+	runCollection, err := db.GetCollection(dbc, dbName, runs)
+	if err != nil {
+		return err
+	}
+
+	_, err = runCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "username", Value: 1}, {Key: "started", Value: -1}},
+	})
+	return err
+}
+
+// Start records the beginning of a backup run. The run is always returned so
+// the backup can go ahead even if it couldn't be recorded.
+func Start(ctx context.Context, dbc *mongo.Client, username string, trigger Trigger) (*Run, error) {
+	run := &Run{
+		Username: username,
+		Trigger:  trigger,
+		Started:  time.Now().UTC(),
+		Counts:   map[string]int{},
+		Totals:   map[string]int{},
+	}
+
+	runCollection, err := db.GetCollection(dbc, dbName, runs)
+	if err != nil {
+		return run, err
+	}
+
+	res, err := runCollection.InsertOne(ctx, run)
+	if err != nil {
+		return run, err
+	}
+	run.ID = res.InsertedID.(primitive.ObjectID)
+	return run, nil
+}
+
+// Finish records the end of a backup run along with its results
+func (r *Run) Finish(ctx context.Context, dbc *mongo.Client) error {
+	r.Finished = time.Now().UTC()
+
+	runCollection, err := db.GetCollection(dbc, dbName, runs)
+	if err != nil {
+		return err
+	}
+
+	if r.ID.IsZero() {
+		res, err := runCollection.InsertOne(ctx, r)
+		if err != nil {
+			return err
+		}
+		r.ID = res.InsertedID.(primitive.ObjectID)
+		return nil
+	}
+
+	_, err = runCollection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: r.ID}}, r)
+	return err
+}
+
+// List returns a page of the user's backup runs, newest first, along with
+// the total number of runs the user has
+func List(ctx context.Context, dbc *mongo.Client, username string, page int64, limit int64) ([]Run, int64, error) {
+	runCollection, err := db.GetCollection(dbc, dbName, runs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filter := bson.D{{Key: "username", Value: username}}
+	total, err := runCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "started", Value: -1}}).
+		SetSkip((page - 1) * limit).
+		SetLimit(limit)
+	cursor, err := runCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	results := []Run{}
+	err = cursor.All(ctx, &results)
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
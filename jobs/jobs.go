@@ -0,0 +1,349 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jarota/ToodleBackupBackend/db"
+	"github.com/jarota/ToodleBackupBackend/history"
+)
+
+const (
+	dbName string = "ToodleBackup"
+	queue  string = "BackupJobs"
+)
+
+// MaxAttempts is how many times a job is claimed before it is given up on,
+// so a backup that keeps taking the server down doesn't run forever
+const MaxAttempts = 3
+
+var (
+	// ErrNoJobs is returned by Claim when there is nothing to do
+	ErrNoJobs = errors.New("jobs: no jobs waiting")
+
+	// ErrLeaseLost is returned when another worker has taken over a job
+	ErrLeaseLost = errors.New("jobs: lease lost")
+)
+
+// Status is where a job is in the queue
+type Status string
+
+// Job statuses
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Stages a running job goes through
+const (
+	StageFetching  = "fetching"
+	StageUploading = "uploading"
+)
+
+// Progress describes what a running job is doing, such as fetching tasks or
+// uploading to Dropbox. Percent is how far through the current step it is.
+type Progress struct {
+	Stage   string `json:"stage"`
+	Detail  string `json:"detail,omitempty"`
+	Percent int    `json:"percent"`
+}
+
+// Job is a request to back up a user's data. A running job belongs to Worker
+// until LeaseUntil, after which another worker may claim it.
+type Job struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username   string             `json:"username"`
+	Trigger    history.Trigger    `json:"trigger"`
+	Status     Status             `json:"status"`
+	Attempts   int                `json:"attempts"`
+	Worker     string             `json:"worker,omitempty"`
+	Enqueued   time.Time          `json:"enqueued"`
+	Started    time.Time          `json:"started"`
+	Finished   time.Time          `json:"finished"`
+	LeaseUntil time.Time          `json:"leaseUntil"`
+	Progress   Progress           `json:"progress"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// EnsureIndexes creates the indexes used to claim jobs, and makes sure a
+// user only has one job waiting and one running at a time
+func EnsureIndexes(ctx context.Context, dbc *mongo.Client) error {
+	jobCollection, err := db.GetCollection(dbc, dbName, queue)
+	if err != nil {
+		return err
+	}
+
+	_, err = jobCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "enqueued", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "status", Value: StatusQueued}}),
+		},
+		{
+			// Two backups for a user at once would both use the same refresh
+			// tokens, and one would find them already used
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "status", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "status", Value: StatusRunning}}),
+		},
+	})
+	return err
+}
+
+// Enqueue adds a backup for the user to the queue. If the user already has a
+// job waiting that job is returned instead of adding another.
+func Enqueue(ctx context.Context, dbc *mongo.Client, username string, trigger history.Trigger) (*Job, error) {
+	jobCollection, err := db.GetCollection(dbc, dbName, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.D{
+		{Key: "username", Value: username},
+		{Key: "status", Value: StatusQueued},
+	}
+	update := bson.D{
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: "trigger", Value: trigger},
+			{Key: "attempts", Value: 0},
+			{Key: "enqueued", Value: time.Now().UTC()},
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var job Job
+	err = jobCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if mongo.IsDuplicateKeyError(err) {
+		// Someone else inserted the user's job at the same time
+		err = jobCollection.FindOne(ctx, filter).Decode(&job)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Claim takes the oldest waiting job for worker, along with any job whose
+// worker stopped renewing its lease. A user's waiting job is left until any job
+// already running for them finishes. ErrNoJobs is returned if there are none.
+func Claim(ctx context.Context, dbc *mongo.Client, worker string, lease time.Duration) (*Job, error) {
+	jobCollection, err := db.GetCollection(dbc, dbName, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	expired := bson.D{
+		{Key: "status", Value: StatusRunning},
+		{Key: "leaseuntil", Value: bson.D{{Key: "$lt", Value: now}}},
+	}
+
+	// Give up on jobs that have been abandoned too many times
+	_, err = jobCollection.UpdateMany(ctx,
+		append(expired, bson.E{Key: "attempts", Value: bson.D{{Key: "$gte", Value: MaxAttempts}}}),
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: StatusFailed},
+			{Key: "finished", Value: now},
+			{Key: "error", Value: fmt.Sprintf("abandoned after %d attempts", MaxAttempts)},
+		}}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "status", Value: StatusRunning},
+			{Key: "worker", Value: worker},
+			{Key: "started", Value: now},
+			{Key: "leaseuntil", Value: now.Add(lease)},
+			{Key: "progress", Value: Progress{}},
+		}},
+		{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "enqueued", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	// Another worker can start a job for the same user between finding who is
+	// busy and claiming, which the unique index turns away, so look again
+	for try := 0; try < 3; try++ {
+		busy, err := jobCollection.Distinct(ctx, "username", bson.D{{Key: "status", Value: StatusRunning}})
+		if err != nil {
+			return nil, err
+		}
+		if busy == nil {
+			busy = bson.A{}
+		}
+
+		filter := bson.D{{Key: "$or", Value: bson.A{
+			bson.D{
+				{Key: "status", Value: StatusQueued},
+				{Key: "username", Value: bson.D{{Key: "$nin", Value: busy}}},
+			},
+			expired,
+		}}}
+
+		var job Job
+		err = jobCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNoJobs
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &job, nil
+	}
+	return nil, ErrNoJobs
+}
+
+// QueueStats describes the jobs waiting in the queue. OldestWait is how long,
+// in seconds, the longest waiting job has been queued.
+type QueueStats struct {
+	Queued     int64   `json:"queued"`
+	Running    int64   `json:"running"`
+	OldestWait float64 `json:"oldestWait"`
+}
+
+// Stats returns how many jobs are waiting and running across every worker
+func Stats(ctx context.Context, dbc *mongo.Client) (*QueueStats, error) {
+	jobCollection, err := db.GetCollection(dbc, dbName, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats QueueStats
+	stats.Queued, err = jobCollection.CountDocuments(ctx, bson.D{{Key: "status", Value: StatusQueued}})
+	if err != nil {
+		return nil, err
+	}
+	stats.Running, err = jobCollection.CountDocuments(ctx, bson.D{{Key: "status", Value: StatusRunning}})
+	if err != nil {
+		return nil, err
+	}
+
+	var oldest Job
+	opts := options.FindOne().SetSort(bson.D{{Key: "enqueued", Value: 1}})
+	err = jobCollection.FindOne(ctx, bson.D{{Key: "status", Value: StatusQueued}}, opts).Decode(&oldest)
+	if err == nil {
+		stats.OldestWait = time.Since(oldest.Enqueued).Seconds()
+	} else if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Get returns the job with the given id
+func Get(ctx context.Context, dbc *mongo.Client, id primitive.ObjectID) (*Job, error) {
+	jobCollection, err := db.GetCollection(dbc, dbName, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	err = jobCollection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Heartbeat extends the job's lease, failing with ErrLeaseLost if it has
+// been claimed by another worker
+func (j *Job) Heartbeat(ctx context.Context, dbc *mongo.Client, lease time.Duration) error {
+	leaseUntil := time.Now().UTC().Add(lease)
+	err := j.update(ctx, dbc, bson.D{{Key: "leaseuntil", Value: leaseUntil}})
+	if err != nil {
+		return err
+	}
+	j.LeaseUntil = leaseUntil
+	return nil
+}
+
+// SetProgress records what the job is doing so it can be followed from any instance
+func (j *Job) SetProgress(ctx context.Context, dbc *mongo.Client, progress Progress) error {
+	err := j.update(ctx, dbc, bson.D{{Key: "progress", Value: progress}})
+	if err != nil {
+		return err
+	}
+	j.Progress = progress
+	return nil
+}
+
+// Complete marks the job as done
+func (j *Job) Complete(ctx context.Context, dbc *mongo.Client) error {
+	finished := time.Now().UTC()
+	err := j.update(ctx, dbc, bson.D{
+		{Key: "status", Value: StatusDone},
+		{Key: "finished", Value: finished},
+	})
+	if err != nil {
+		return err
+	}
+	j.Status, j.Finished = StatusDone, finished
+	return nil
+}
+
+// Fail marks the job as failed with the error that stopped it
+func (j *Job) Fail(ctx context.Context, dbc *mongo.Client, cause error) error {
+	finished := time.Now().UTC()
+	err := j.update(ctx, dbc, bson.D{
+		{Key: "status", Value: StatusFailed},
+		{Key: "finished", Value: finished},
+		{Key: "error", Value: cause.Error()},
+	})
+	if err != nil {
+		return err
+	}
+	j.Status, j.Finished, j.Error = StatusFailed, finished, cause.Error()
+	return nil
+}
+
+// update sets fields on the job as long as this worker still holds it
+func (j *Job) update(ctx context.Context, dbc *mongo.Client, fields bson.D) error {
+	jobCollection, err := db.GetCollection(dbc, dbName, queue)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.D{
+		{Key: "_id", Value: j.ID},
+		{Key: "status", Value: StatusRunning},
+		{Key: "worker", Value: j.Worker},
+	}
+	res, err := jobCollection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: fields}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// WorkerID names this process so jobs can be traced back to it
+func WorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
@@ -0,0 +1,243 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// DefaultWorkers is how many jobs a pool runs at once
+	DefaultWorkers = 4
+
+	// DefaultLease is how long a worker holds a job between heartbeats
+	DefaultLease = 2 * time.Minute
+
+	// DefaultPollInterval is how long an idle worker waits before looking for jobs
+	DefaultPollInterval = 5 * time.Second
+
+	// DefaultDrainTimeout is how long running jobs have to finish when the pool stops
+	DefaultDrainTimeout = 2 * time.Minute
+)
+
+// Handler does the work for a job. The context is cancelled if the job's
+// lease is lost, or the pool stops and the job doesn't finish in time.
+type Handler func(ctx context.Context, job *Job) error
+
+// Pool is a set of workers draining the job queue
+type Pool struct {
+	DBC          *mongo.Client
+	Handler      Handler
+	Workers      int
+	Lease        time.Duration
+	PollInterval time.Duration
+	DrainTimeout time.Duration
+
+	// ID identifies the pool's process, each worker is named after it
+	ID string
+
+	mu        sync.Mutex
+	busy      int
+	completed int64
+	failed    int64
+	waited    time.Duration
+}
+
+// PoolStats counts the jobs a pool has run. AverageWait is the mean time, in
+// seconds, that jobs spent queued before a worker claimed them.
+type PoolStats struct {
+	Workers     int     `json:"workers"`
+	Busy        int     `json:"busy"`
+	Completed   int64   `json:"completed"`
+	Failed      int64   `json:"failed"`
+	AverageWait float64 `json:"averageWait"`
+}
+
+// NewPool creates a pool with the default settings
+func NewPool(dbc *mongo.Client, handler Handler) *Pool {
+	return &Pool{
+		DBC:          dbc,
+		Handler:      handler,
+		Workers:      DefaultWorkers,
+		Lease:        DefaultLease,
+		PollInterval: DefaultPollInterval,
+		DrainTimeout: DefaultDrainTimeout,
+		ID:           WorkerID(),
+	}
+}
+
+// Run starts the workers and blocks until ctx is cancelled and the pool has
+// drained. Once ctx is cancelled no more jobs are claimed, and jobs already
+// running have DrainTimeout to finish before they are cancelled too, then
+// DrainTimeout again to stop before Run returns without them.
+func (p *Pool) Run(ctx context.Context) {
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers(); i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			p.work(ctx, jobCtx, name)
+		}(fmt.Sprintf("%s/%d", p.ID, i))
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	<-ctx.Done()
+	select {
+	case <-drained:
+	case <-time.After(p.drainTimeout()):
+		log.Printf("Cancelling backup jobs still running after %v\n", p.drainTimeout())
+		cancelJobs()
+
+		// A job stuck somewhere that ignores cancellation is left for its lease
+		// to run out, so another worker can take it over
+		select {
+		case <-drained:
+		case <-time.After(p.drainTimeout()):
+			log.Printf("Giving up on backup jobs that didn't stop when cancelled\n")
+		}
+	}
+}
+
+// work claims jobs until ctx is cancelled, running them with jobCtx
+func (p *Pool) work(ctx context.Context, jobCtx context.Context, name string) {
+	for ctx.Err() == nil {
+		job, err := Claim(ctx, p.DBC, name, p.lease())
+		if err != nil {
+			if err != ErrNoJobs && ctx.Err() == nil {
+				log.Printf("Error claiming backup job: %v\n", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(p.pollInterval()):
+			}
+			continue
+		}
+
+		p.run(jobCtx, job)
+	}
+}
+
+// Stats returns counts of the jobs run since the pool started
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := PoolStats{
+		Workers:   p.workers(),
+		Busy:      p.busy,
+		Completed: p.completed,
+		Failed:    p.failed,
+	}
+	if finished := p.completed + p.failed; finished > 0 {
+		stats.AverageWait = (p.waited / time.Duration(finished)).Seconds()
+	}
+	return stats
+}
+
+// run runs a single job, renewing its lease until the handler returns
+func (p *Pool) run(ctx context.Context, job *Job) {
+	p.mu.Lock()
+	p.busy++
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.busy--
+		p.mu.Unlock()
+	}()
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(p.lease() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := job.Heartbeat(jobCtx, p.DBC, p.lease())
+				if err == ErrLeaseLost {
+					log.Printf("Lost lease on backup job %s for %s\n", job.ID.Hex(), job.Username)
+					cancel()
+					return
+				}
+				if err != nil {
+					log.Printf("Error renewing lease on backup job %s: %v\n", job.ID.Hex(), err)
+				}
+			}
+		}
+	}()
+
+	err := p.Handler(jobCtx, job)
+	close(done)
+	<-stopped
+
+	// A job cancelled by shutdown is left for its lease to expire, so it is
+	// picked up again rather than recorded as failed
+	if err != nil && ctx.Err() != nil {
+		log.Printf("Backup job %s for %s interrupted: %v\n", job.ID.Hex(), job.Username, err)
+		return
+	}
+
+	p.mu.Lock()
+	if err != nil {
+		p.failed++
+	} else {
+		p.completed++
+	}
+	p.waited += job.Started.Sub(job.Enqueued)
+	p.mu.Unlock()
+
+	if err != nil {
+		err = job.Fail(context.Background(), p.DBC, err)
+	} else {
+		err = job.Complete(context.Background(), p.DBC)
+	}
+	if err != nil {
+		log.Printf("Error finishing backup job %s for %s: %v\n", job.ID.Hex(), job.Username, err)
+	}
+}
+
+func (p *Pool) workers() int {
+	if p.Workers < 1 {
+		return DefaultWorkers
+	}
+	return p.Workers
+}
+
+func (p *Pool) drainTimeout() time.Duration {
+	if p.DrainTimeout <= 0 {
+		return DefaultDrainTimeout
+	}
+	return p.DrainTimeout
+}
+
+func (p *Pool) lease() time.Duration {
+	if p.Lease <= 0 {
+		return DefaultLease
+	}
+	return p.Lease
+}
+
+func (p *Pool) pollInterval() time.Duration {
+	if p.PollInterval <= 0 {
+		return DefaultPollInterval
+	}
+	return p.PollInterval
+}
@@ -0,0 +1,92 @@
+package lease
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/jarota/ToodleBackupBackend/db"
+)
+
+const (
+	dbName string = "ToodleBackup"
+	leases string = "Leases"
+)
+
+// Lease gives one instance of the backend sole charge of something, such as
+// scheduling, until Expires. Expired leases are removed by mongodb.
+type Lease struct {
+	Name    string    `bson:"_id" json:"name"`
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// EnsureIndexes has mongodb remove leases once they expire
+func EnsureIndexes(ctx context.Context, dbc *mongo.Client) error {
+	leaseCollection, err := db.GetCollection(dbc, dbName, leases)
+	if err != nil {
+		return err
+	}
+
+	_, err = leaseCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Acquire takes or renews the named lease for holder, reporting whether
+// holder has it. It only succeeds if the lease is free, expired or already
+// held by holder.
+func Acquire(ctx context.Context, dbc *mongo.Client, name string, holder string, ttl time.Duration) (bool, error) {
+	leaseCollection, err := db.GetCollection(dbc, dbName, leases)
+	if err != nil {
+		return false, err
+	}
+
+	// The ttl monitor only runs every minute, so don't rely on it to have
+	// removed an expired lease
+	now := time.Now().UTC()
+	filter := bson.D{
+		{Key: "_id", Value: name},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "holder", Value: holder}},
+			bson.D{{Key: "expires", Value: bson.D{{Key: "$lt", Value: now}}}},
+		}},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "holder", Value: holder},
+			{Key: "expires", Value: now.Add(ttl)},
+		}},
+	}
+
+	_, err = leaseCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The lease exists and belongs to someone else
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Release gives up the named lease if holder has it, so another instance can
+// take over straight away
+func Release(ctx context.Context, dbc *mongo.Client, name string, holder string) error {
+	leaseCollection, err := db.GetCollection(dbc, dbName, leases)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.D{
+		{Key: "_id", Value: name},
+		{Key: "holder", Value: holder},
+	}
+	_, err = leaseCollection.DeleteOne(ctx, filter)
+	return err
+}
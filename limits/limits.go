@@ -0,0 +1,139 @@
+package limits
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Toodledo is the name the toodledo api is limited under, storage providers
+// are limited under their cloud names
+const Toodledo = "Toodledo"
+
+// Stats describes how busy an upstream is. A Limit of 0 means unlimited.
+type Stats struct {
+	Limit   int   `json:"limit"`
+	Active  int64 `json:"active"`
+	Waiting int64 `json:"waiting"`
+}
+
+// Limiter caps how many backups can use each upstream at once
+type Limiter struct {
+	mu        sync.Mutex
+	limits    map[string]int
+	fallback  int
+	upstreams map[string]*upstream
+}
+
+type upstream struct {
+	slots   chan struct{}
+	active  int64
+	waiting int64
+}
+
+// Default is the limiter shared by every backup in the process, it allows two
+// backups to talk to toodledo and four to each storage provider at once
+var Default = New(map[string]int{Toodledo: 2, "*": 4})
+
+// New creates a limiter from per-upstream limits, with "*" used for any
+// upstream not listed. A limit of 0 or less means unlimited.
+func New(limits map[string]int) *Limiter {
+	l := &Limiter{limits: map[string]int{}, upstreams: map[string]*upstream{}}
+	for name, n := range limits {
+		if name == "*" {
+			l.fallback = n
+		} else {
+			l.limits[name] = n
+		}
+	}
+	return l
+}
+
+// Parse reads limits written like "Toodledo=2,Dropbox=4,*=8"
+func Parse(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("limits: expected name=limit, found %q", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("limits: invalid limit in %q", part)
+		}
+		limits[strings.TrimSpace(part[:i])] = n
+	}
+	return limits, nil
+}
+
+// Acquire waits for a free slot on the upstream. The returned function must
+// be called to give the slot back.
+func (l *Limiter) Acquire(ctx context.Context, name string) (func(), error) {
+	u := l.upstream(name)
+
+	l.add(&u.waiting, 1)
+	if u.slots != nil {
+		select {
+		case u.slots <- struct{}{}:
+		case <-ctx.Done():
+			l.add(&u.waiting, -1)
+			return nil, ctx.Err()
+		}
+	}
+	l.add(&u.waiting, -1)
+	l.add(&u.active, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.add(&u.active, -1)
+			if u.slots != nil {
+				<-u.slots
+			}
+		})
+	}, nil
+}
+
+// Stats returns how busy every upstream that has been used is
+func (l *Limiter) Stats() map[string]Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := map[string]Stats{}
+	for name, u := range l.upstreams {
+		stats[name] = Stats{Limit: cap(u.slots), Active: u.active, Waiting: u.waiting}
+	}
+	return stats
+}
+
+// upstream returns the state for name, creating it on first use
+func (l *Limiter) upstream(name string) *upstream {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	u, ok := l.upstreams[name]
+	if !ok {
+		limit, ok := l.limits[name]
+		if !ok {
+			limit = l.fallback
+		}
+		u = &upstream{}
+		if limit > 0 {
+			u.slots = make(chan struct{}, limit)
+		}
+		l.upstreams[name] = u
+	}
+	return u
+}
+
+func (l *Limiter) add(counter *int64, delta int64) {
+	l.mu.Lock()
+	*counter += delta
+	l.mu.Unlock()
+}
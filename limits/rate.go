@@ -0,0 +1,100 @@
+package limits
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Rate limits how often something can happen, allowing short bursts. It is a
+// token bucket holding up to burst tokens, refilled at perMinute a minute.
+type Rate struct {
+	mu          sync.Mutex
+	perSecond   float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// NewRate allows perMinute events a minute, and up to burst at once. A
+// perMinute of 0 or less means unlimited.
+func NewRate(perMinute int, burst int) *Rate {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Rate{
+		perSecond: float64(perMinute) / 60,
+		burst:     float64(burst),
+		tokens:    float64(burst),
+		last:      time.Now(),
+	}
+}
+
+// Wait blocks until an event is allowed or ctx is cancelled
+func (r *Rate) Wait(ctx context.Context) error {
+	for {
+		wait := r.reserve(time.Now())
+		if wait <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Pause stops any events being allowed for d, such as when the other end
+// says we have gone over its limit
+func (r *Rate) Pause(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Start again with an empty bucket, rather than a burst that could take us
+	// straight back over the limit
+	until := time.Now().Add(d)
+	if until.After(r.pausedUntil) {
+		r.pausedUntil = until
+		r.tokens = 0
+		r.last = until
+	}
+}
+
+// Idle reports whether nothing has happened since before t
+func (r *Rate) Idle(t time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last.Before(t) && r.pausedUntil.Before(t)
+}
+
+// reserve takes a token if there is one, otherwise returning how long until
+// there might be
+func (r *Rate) reserve(now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Before(r.pausedUntil) {
+		return r.pausedUntil.Sub(now)
+	}
+	if r.perSecond <= 0 {
+		r.last = now
+		return 0
+	}
+
+	r.tokens += now.Sub(r.last).Seconds() * r.perSecond
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	if r.tokens >= 1 {
+		r.tokens--
+		return 0
+	}
+	return time.Duration((1 - r.tokens) / r.perSecond * float64(time.Second))
+}
@@ -0,0 +1,181 @@
+package localfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// Name is the cloud name local destinations are registered under
+const Name = "Local"
+
+// ErrNotConfigured is returned when no backup directory has been set for the server
+var ErrNotConfigured = errors.New("localfs: BACKUPDIR is not set")
+
+func init() {
+	storage.Register(Name, open)
+}
+
+// Root returns the directory backups are written under, set with BACKUPDIR
+func Root() string {
+	return os.Getenv("BACKUPDIR")
+}
+
+// Enabled reports whether the server has been configured with a backup directory
+func Enabled() bool {
+	return Root() != ""
+}
+
+// destination stores backups in a per-user folder under the server's backup directory
+type destination struct {
+	dir string
+}
+
+func open(_ context.Context, u *user.User, _ *user.Cloud) (storage.Destination, error) {
+	root := Root()
+	if root == "" {
+		return nil, ErrNotConfigured
+	}
+
+	folder, err := safeName(u.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &destination{dir: filepath.Join(root, folder)}, nil
+}
+
+// Upload writes to a temporary file which is synced and renamed into place, so
+// a crash never leaves a partial backup under the final name
+func (d *destination) Upload(_ context.Context, name string, r io.Reader, _ int64) error {
+	final, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(d.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(d.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Sync the directory too so the rename itself is durable
+	dir, err := os.Open(d.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (d *destination) List(_ context.Context) ([]storage.FileInfo, error) {
+	entries, err := ioutil.ReadDir(d.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storage.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		// Skip temporary files from uploads in progress
+		if e.Mode().IsRegular() && !strings.HasPrefix(e.Name(), ".tmp-") {
+			files = append(files, toFileInfo(e))
+		}
+	}
+	return files, nil
+}
+
+func (d *destination) Delete(_ context.Context, name string) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+func (d *destination) Stat(_ context.Context, name string) (*storage.FileInfo, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := toFileInfo(fi)
+	return &info, nil
+}
+
+// Quota reports the space taken by the user's backups, there is no per-user limit
+func (d *destination) Quota(ctx context.Context) (*storage.Quota, error) {
+	files, err := d.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var used int64
+	for _, f := range files {
+		used += f.Size
+	}
+	return &storage.Quota{Used: used}, nil
+}
+
+// path returns where the file called name lives, refusing anything that
+// would escape the user's folder
+func (d *destination) path(name string) (string, error) {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("localfs: invalid file name %q", name)
+	}
+	return filepath.Join(d.dir, name), nil
+}
+
+func toFileInfo(fi os.FileInfo) storage.FileInfo {
+	return storage.FileInfo{Name: fi.Name(), Size: fi.Size(), Modified: fi.ModTime()}
+}
+
+// safeName turns a username into a single path element
+func safeName(username string) (string, error) {
+	if username == "" || username == "." || username == ".." {
+		return "", fmt.Errorf("localfs: invalid username %q", username)
+	}
+	return url.PathEscape(username), nil
+}
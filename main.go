@@ -6,6 +6,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	// Embed the timezone database so user timezones work without zoneinfo on the host
+	_ "time/tzdata"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -15,14 +22,83 @@ import (
 
 	"github.com/jarota/ToodleBackupBackend/db"
 	"github.com/jarota/ToodleBackupBackend/handlers"
+	"github.com/jarota/ToodleBackupBackend/history"
+	"github.com/jarota/ToodleBackupBackend/jobs"
+	"github.com/jarota/ToodleBackupBackend/lease"
+	"github.com/jarota/ToodleBackupBackend/limits"
 	"github.com/jarota/ToodleBackupBackend/scheduler"
+	"github.com/jarota/ToodleBackupBackend/toodledo"
+
+	// Storage destinations register themselves with the storage package
+	_ "github.com/jarota/ToodleBackupBackend/dropbox"
+	_ "github.com/jarota/ToodleBackupBackend/gdrive"
+	_ "github.com/jarota/ToodleBackupBackend/localfs"
+	_ "github.com/jarota/ToodleBackupBackend/onedrive"
+	_ "github.com/jarota/ToodleBackupBackend/s3"
+	_ "github.com/jarota/ToodleBackupBackend/sftp"
+	_ "github.com/jarota/ToodleBackupBackend/webdav"
 )
 
 func main() {
 	fmt.Println("Starting Toodle Backup Backend...")
 	ctx := context.Background()
 	dbc := db.ConnectToMongoDB(ctx)
-	defer dbc.Disconnect(ctx)
+
+	err := history.EnsureIndexes(ctx, dbc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = jobs.EnsureIndexes(ctx, dbc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = lease.EnsureIndexes(ctx, dbc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Workers run queued backups, WORKERS sets how many at once, UPSTREAMLIMITS
+	// how many of those can use each service and SHUTDOWNTIMEOUT how long they
+	// have to finish when the server is stopped
+	pool := jobs.NewPool(dbc, scheduler.HandleJob(dbc))
+	if workers, err := strconv.Atoi(os.Getenv("WORKERS")); err == nil && workers > 0 {
+		pool.Workers = workers
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("SHUTDOWNTIMEOUT")); err == nil && timeout > 0 {
+		pool.DrainTimeout = timeout
+	}
+	if s := os.Getenv("UPSTREAMLIMITS"); s != "" {
+		upstreams, err := limits.Parse(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limits.Default = limits.New(upstreams)
+	}
+
+	// TOODLEDOURL points the toodledo client somewhere other than the real api,
+	// and TOODLEDORATES sets how many requests a minute can be made by the app
+	// and with each token, like "app=300,token=60". Each instance of the backend
+	// keeps to these by itself, so with several the app rate should be divided
+	// between them.
+	if s := os.Getenv("TOODLEDOURL"); s != "" {
+		toodledo.DefaultBaseURL = s
+	}
+	if s := os.Getenv("TOODLEDORATES"); s != "" {
+		rates, err := limits.Parse(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		appRate, tokenRate := toodledo.DefaultAppRate, toodledo.DefaultTokenRate
+		if n, ok := rates["app"]; ok {
+			appRate = n
+		}
+		if n, ok := rates["token"]; ok {
+			tokenRate = n
+		}
+		toodledo.DefaultThrottle = toodledo.NewThrottle(appRate, tokenRate)
+	}
 
 	app := fiber.New()
 
@@ -35,10 +111,24 @@ func main() {
 	app.Static("/", "./frontend")
 	app.Static("/toodleredirect", "./frontend")
 	app.Static("/dropboxredirect", "./frontend")
+	app.Static("/googleredirect", "./frontend")
+	app.Static("/onedriveredirect", "./frontend")
 
 	app.Post("/api/register", handlers.Register(dbc))
 	app.Post("/api/login", handlers.Login(dbc))
 
+	// Metrics are only served to whoever sends METRICSTOKEN as a bearer token
+	app.Get("/api/metrics", handlers.Metrics(dbc, pool, os.Getenv("METRICSTOKEN")))
+
+	// Browsers can't set headers on an EventSource, so following a backup takes
+	// the token from the query string instead. It is registered before the other
+	// routes so that only this one accepts tokens that could end up in logs.
+	app.Get("/api/backups/:id/events", jwtware.New(jwtware.Config{
+		SigningKey:  []byte(os.Getenv("SECRET")),
+		ContextKey:  "userInfo",
+		TokenLookup: "query:token",
+	}), handlers.BackupEvents(dbc))
+
 	app.Use(jwtware.New(jwtware.Config{
 		SigningKey: []byte(os.Getenv("SECRET")),
 		ContextKey: "userInfo",
@@ -48,9 +138,19 @@ func main() {
 	app.Post("/api/logout", handlers.Logout(dbc))
 	app.Put("/api/connToodledo", handlers.ConnToodledo(dbc))
 	app.Put("/api/connDropbox", handlers.ConnDropbox(dbc))
+	app.Put("/api/connS3", handlers.ConnS3(dbc))
+	app.Put("/api/connGoogleDrive", handlers.ConnGoogleDrive(dbc))
+	app.Put("/api/connOneDrive", handlers.ConnOneDrive(dbc))
+	app.Put("/api/connWebDAV", handlers.ConnWebDAV(dbc))
+	app.Put("/api/connSFTP", handlers.ConnSFTP(dbc))
 	app.Put("/api/setBackupFrequency", handlers.SetBackupFrequency(dbc))
 	app.Put("/api/setBackupTime", handlers.SetBackupTime(dbc))
+	app.Put("/api/setBackupCron", handlers.SetBackupCron(dbc))
+	app.Put("/api/setTimezone", handlers.SetTimezone(dbc))
+	app.Put("/api/setRetention", handlers.SetRetention(dbc))
 	app.Get("/api/backupUser", handlers.BackupUser(dbc))
+	app.Get("/api/backups", handlers.GetBackups(dbc))
+	app.Get("/api/backups/:id", handlers.GetBackup(dbc))
 
 	app.Get("/api/randomString", handlers.RandomString(dbc))
 
@@ -69,9 +169,67 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Spin up scheduler
-	go scheduler.PollForPendingBackups(ctx, dbc)
+	err = scheduler.CleanTempFiles()
+	if err != nil {
+		log.Printf("Error cleaning up old backup files: %v\n", err)
+	}
+
+	// Stop cleanly on ctrl-c or when the process manager asks us to
+	stopCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Spin up scheduler, and the workers that run the backups it queues
+	polling := make(chan struct{})
+	go func() {
+		scheduler.PollForPendingBackups(stopCtx, dbc)
+		close(polling)
+	}()
+
+	draining := make(chan struct{})
+	go func() {
+		pool.Run(stopCtx)
+		close(draining)
+	}()
 
 	// Start webserver
-	log.Fatal(app.Listener(ln))
+	serving := make(chan error, 1)
+	go func() {
+		serving <- app.Listener(ln)
+	}()
+
+	select {
+	case err := <-serving:
+		log.Fatal(err)
+	case <-stopCtx.Done():
+	}
+	// A second signal kills the process straight away
+	stop()
+	log.Println("Shutting down, waiting for backups in progress to finish")
+
+	// Stop taking requests while the workers finish their backups
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- app.Shutdown()
+	}()
+	<-polling
+	<-draining
+
+	// The job queue has drained, so give any requests still being answered a
+	// moment more before giving up on them
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			log.Printf("Error shutting down webserver: %v\n", err)
+		}
+	case <-time.After(10 * time.Second):
+		log.Println("Gave up waiting for requests to finish")
+	}
+
+	disconnectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err = dbc.Disconnect(disconnectCtx)
+	if err != nil {
+		log.Printf("Error disconnecting from MongoDB: %v\n", err)
+	}
+	fmt.Println("Stopped Toodle Backup Backend")
 }
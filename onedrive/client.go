@@ -0,0 +1,305 @@
+package onedrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/retry"
+)
+
+// DefaultBaseURL is the root of the microsoft graph api, where clients send
+// requests unless told otherwise
+var DefaultBaseURL = "https://graph.microsoft.com/v1.0"
+
+const (
+	// maxSimpleUpload is the largest file graph accepts in a single PUT
+	maxSimpleUpload int64 = 4 << 20
+
+	// uploadGranularity is the multiple every upload session chunk but the last must be
+	uploadGranularity int64 = 320 << 10
+
+	// DefaultChunkSize is the size of each request in an upload session
+	DefaultChunkSize int64 = 32 * uploadGranularity
+)
+
+// ErrItemNotFound is returned when a file does not exist in the app folder
+var ErrItemNotFound = errors.New("onedrive: item not found")
+
+// APIError describes an error response from the graph api
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("onedrive: status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is lets errors.Is match an APIError against ErrItemNotFound
+func (e *APIError) Is(target error) bool {
+	return target == ErrItemNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *APIError) Temporary() bool {
+	return retry.StatusTemporary(e.StatusCode)
+}
+
+// Item is the subset of drive item metadata we care about
+type Item struct {
+	ID                   string    `json:"id"`
+	Name                 string    `json:"name"`
+	Size                 int64     `json:"size"`
+	LastModifiedDateTime time.Time `json:"lastModifiedDateTime"`
+	File                 *struct{} `json:"file"`
+}
+
+// Quota is the user's drive usage in bytes
+type Quota struct {
+	Total int64 `json:"total"`
+	Used  int64 `json:"used"`
+}
+
+// Client talks to the user's onedrive app folder with a short-lived access token
+type Client struct {
+	Token      string
+	BaseURL    string
+	ChunkSize  int64
+	HTTPClient *http.Client
+}
+
+// NewClient creates a client for the real graph api
+func NewClient(token string) *Client {
+	return &Client{
+		Token:      token,
+		BaseURL:    DefaultBaseURL,
+		ChunkSize:  DefaultChunkSize,
+		HTTPClient: &http.Client{},
+	}
+}
+
+type errorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Upload writes size bytes from r to name in the app folder, replacing any
+// existing file, using an upload session for large files. A negative size
+// means unknown.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader, size int64) (*Item, error) {
+	if size < 0 {
+		// Every chunk of an upload session has to give the total size, so find
+		// out what it is first
+		f, err := ioutil.TempFile("", "onedrive-upload-*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		size, err = io.Copy(f, r)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+
+	if size <= maxSimpleUpload {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.itemURL(name)+":/content", r)
+		if err != nil {
+			return nil, err
+		}
+		// Send the length up front rather than a chunked body
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		var item Item
+		_, err = c.send(req, &item)
+		if err != nil {
+			return nil, err
+		}
+		return &item, nil
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"item": map[string]string{"@microsoft.graph.conflictBehavior": "replace"},
+	})
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	err := c.do(ctx, http.MethodPost, c.itemURL(name)+":/createUploadSession", bytes.NewReader(body), "application/json", &session)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.uploadChunks(ctx, session.UploadURL, r, size)
+}
+
+func (c *Client) uploadChunks(ctx context.Context, uploadURL string, r io.Reader, size int64) (*Item, error) {
+	buf := make([]byte, c.chunkSize())
+	var offset int64
+	for {
+		chunk := buf
+		if remaining := size - offset; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := io.ReadFull(r, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, bytes.NewReader(chunk[:n]))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size))
+
+		// The upload url is pre-authenticated so no bearer token is sent
+		var item Item
+		status, err := c.send(req, &item)
+		if err != nil {
+			return nil, err
+		}
+		offset += int64(n)
+
+		if status != http.StatusAccepted {
+			return &item, nil
+		}
+		if offset >= size {
+			return nil, errors.New("onedrive: upload incomplete after final chunk")
+		}
+	}
+}
+
+// Children returns the files in the app folder
+func (c *Client) Children(ctx context.Context) ([]Item, error) {
+	var items []Item
+	next := c.BaseURL + "/me/drive/special/approot/children?$select=id,name,size,lastModifiedDateTime,file&$top=1000"
+	for next != "" {
+		var page struct {
+			Value    []Item `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		err := c.do(ctx, http.MethodGet, next, nil, "", &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range page.Value {
+			if item.File != nil {
+				items = append(items, item)
+			}
+		}
+		next = page.NextLink
+	}
+	return items, nil
+}
+
+// GetItem returns the metadata of name in the app folder
+func (c *Client) GetItem(ctx context.Context, name string) (*Item, error) {
+	var item Item
+	err := c.do(ctx, http.MethodGet, c.itemURL(name), nil, "", &item)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// DeleteItem removes name from the app folder
+func (c *Client) DeleteItem(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, c.itemURL(name), nil, "", nil)
+}
+
+// GetQuota returns how much of the user's drive is in use
+func (c *Client) GetQuota(ctx context.Context) (*Quota, error) {
+	var drive struct {
+		Quota Quota `json:"quota"`
+	}
+	err := c.do(ctx, http.MethodGet, c.BaseURL+"/me/drive?$select=quota", nil, "", &drive)
+	if err != nil {
+		return nil, err
+	}
+	return &drive.Quota, nil
+}
+
+// itemURL addresses name inside the app folder by path
+func (c *Client) itemURL(name string) string {
+	return c.BaseURL + "/me/drive/special/approot:/" + url.PathEscape(name)
+}
+
+func (c *Client) do(ctx context.Context, method string, endpoint string, body io.Reader, contentType string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	_, err = c.send(req, out)
+	return err
+}
+
+func (c *Client) send(req *http.Request, out interface{}) (int, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errResp errorResponse
+		if json.Unmarshal(data, &errResp) != nil || errResp.Error.Code == "" {
+			errResp.Error.Code = http.StatusText(resp.StatusCode)
+			errResp.Error.Message = strings.TrimSpace(string(data))
+		}
+		return 0, &APIError{StatusCode: resp.StatusCode, Code: errResp.Error.Code, Message: errResp.Error.Message}
+	}
+
+	if out != nil && len(data) > 0 {
+		err = json.Unmarshal(data, out)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *Client) chunkSize() int64 {
+	if c.ChunkSize < uploadGranularity {
+		return DefaultChunkSize
+	}
+	return c.ChunkSize - c.ChunkSize%uploadGranularity
+}
@@ -0,0 +1,283 @@
+package onedrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+const approot = "/me/drive/special/approot"
+
+var contentRange = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// fakeGraph keeps an app folder in memory. Children are listed a page of
+// pageSize at a time and folders are listed along with files.
+type fakeGraph struct {
+	t        *testing.T
+	url      string
+	pageSize int
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	sessions map[string]*fakeSession
+	requests []string
+}
+
+type fakeSession struct {
+	name string
+	data []byte
+}
+
+func newFakeGraph(t *testing.T) (*fakeGraph, *httptest.Server) {
+	f := &fakeGraph{t: t, pageSize: 2, files: map[string][]byte{}, sessions: map[string]*fakeSession{}}
+	srv := httptest.NewServer(f)
+	f.url = srv.URL
+	return f, srv
+}
+
+func (f *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.URL.Path == "/token" {
+		fmt.Fprint(w, `{"access_token":"access","refresh_token":"rotated"}`)
+		return
+	}
+
+	// Upload urls are pre-authenticated, everything else needs the token
+	if strings.HasPrefix(r.URL.Path, "/sessions/") {
+		if r.Header.Get("Authorization") != "" {
+			f.t.Errorf("%s %s sent the access token to an upload url", r.Method, r.URL.Path)
+		}
+		f.requests = append(f.requests, r.Header.Get("Content-Range"))
+		f.upload(w, f.sessions[strings.TrimPrefix(r.URL.Path, "/sessions/")], r.Header.Get("Content-Range"), body)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer access" {
+		f.fail(w, http.StatusUnauthorized, "InvalidAuthenticationToken")
+		return
+	}
+
+	switch {
+	case r.URL.Path == approot+"/children":
+		f.children(w, r)
+	case r.URL.Path == "/me/drive":
+		fmt.Fprintf(w, `{"quota":{"total":%d,"used":%d}}`, 1<<30, f.used())
+	case strings.HasPrefix(r.URL.Path, approot+":/"):
+		name := strings.TrimPrefix(r.URL.Path, approot+":/")
+		switch {
+		case r.Method == http.MethodPut && strings.HasSuffix(name, ":/content"):
+			f.requests = append(f.requests, "PUT content")
+			if r.ContentLength != int64(len(body)) || len(r.TransferEncoding) > 0 {
+				f.t.Errorf("simple upload sent %d bytes with Content-Length %d", len(body), r.ContentLength)
+			}
+			name = strings.TrimSuffix(name, ":/content")
+			f.files[name] = body
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(f.item(name))
+		case r.Method == http.MethodPost && strings.HasSuffix(name, ":/createUploadSession"):
+			id := strconv.Itoa(len(f.sessions) + 1)
+			f.sessions[id] = &fakeSession{name: strings.TrimSuffix(name, ":/createUploadSession")}
+			fmt.Fprintf(w, `{"uploadUrl":%q}`, f.url+"/sessions/"+id)
+		case f.files[name] == nil:
+			f.fail(w, http.StatusNotFound, "itemNotFound")
+		case r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(f.item(name))
+		case r.Method == http.MethodDelete:
+			delete(f.files, name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		f.fail(w, http.StatusNotFound, "itemNotFound")
+	}
+}
+
+func (f *fakeGraph) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%q,"message":"no"}}`, code)
+}
+
+func (f *fakeGraph) item(name string) Item {
+	return Item{ID: "id-" + name, Name: name, Size: int64(len(f.files[name])), LastModifiedDateTime: time.Now().UTC(), File: &struct{}{}}
+}
+
+func (f *fakeGraph) used() int {
+	used := 0
+	for _, data := range f.files {
+		used += len(data)
+	}
+	return used
+}
+
+func (f *fakeGraph) children(w http.ResponseWriter, r *http.Request) {
+	items := []Item{{ID: "folder", Name: "folder"}}
+	for name := range f.files {
+		items = append(items, f.item(name))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("$skiptoken"))
+	var page struct {
+		Value    []Item `json:"value"`
+		NextLink string `json:"@odata.nextLink,omitempty"`
+	}
+	for i := start; i < len(items) && i < start+f.pageSize; i++ {
+		page.Value = append(page.Value, items[i])
+	}
+	if start+f.pageSize < len(items) {
+		page.NextLink = fmt.Sprintf("%s%s/children?$skiptoken=%d", f.url, approot, start+f.pageSize)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// upload takes one chunk of an upload session, answering 202 until the
+// whole file has arrived
+func (f *fakeGraph) upload(w http.ResponseWriter, s *fakeSession, header string, chunk []byte) {
+	m := contentRange.FindStringSubmatch(header)
+	if s == nil || m == nil {
+		f.fail(w, http.StatusBadRequest, "invalidRequest")
+		return
+	}
+	first, _ := strconv.Atoi(m[1])
+	last, _ := strconv.Atoi(m[2])
+	if first != len(s.data) || last-first+1 != len(chunk) {
+		f.t.Errorf("chunk %s doesn't follow the %d bytes received", header, len(s.data))
+	}
+	s.data = append(s.data, chunk...)
+
+	if m[3] != strconv.Itoa(len(s.data)) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"nextExpectedRanges":["%d-"]}`, len(s.data))
+		return
+	}
+	f.files[s.name] = s.data
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f.item(s.name))
+}
+
+func TestDestination(t *testing.T) {
+	fake, srv := newFakeGraph(t)
+	defer srv.Close()
+
+	baseURL, tokenURL := DefaultBaseURL, TokenURL
+	DefaultBaseURL, TokenURL = srv.URL, srv.URL+"/token"
+	defer func() { DefaultBaseURL, TokenURL = baseURL, tokenURL }()
+
+	ctx := context.Background()
+	cloud := &user.Cloud{Name: Name, Token: "refresh"}
+	dest, err := storage.Open(ctx, &user.User{}, cloud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloud.Token != "rotated" {
+		t.Errorf("cloud token is %q after opening, want the rotated refresh token", cloud.Token)
+	}
+
+	for _, name := range []string{"a.xml", "b.xml", "2026-10-18T10:00:00.xml"} {
+		err = dest.Upload(ctx, name, strings.NewReader("backup "+name), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := dest.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "2026-10-18T10-00-00.xml,a.xml,b.xml" {
+		t.Errorf("List() = %v, want the three backups but not the folder", names)
+	}
+
+	quota, err := dest.Quota(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Used != int64(fake.used()) || quota.Total != 1<<30 {
+		t.Errorf("Quota() = %+v", quota)
+	}
+
+	err = dest.Delete(ctx, "2026-10-18T10:00:00.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.Delete(ctx, "2026-10-18T10:00:00.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("deleting a missing file returned %v, want storage.ErrNotFound", err)
+	}
+	_, err = dest.Stat(ctx, "2026-10-18T10:00:00.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("Stat() of a deleted file returned %v, want storage.ErrNotFound", err)
+	}
+}
+
+func TestUploadSession(t *testing.T) {
+	chunk := 4 * int(uploadGranularity)
+	large := int(maxSimpleUpload) + 10
+
+	// A large file goes up in whole chunks with whatever is left over last
+	var ranges []string
+	for offset := 0; offset < large; offset += chunk {
+		end := offset + chunk
+		if end > large {
+			end = large
+		}
+		ranges = append(ranges, fmt.Sprintf("bytes %d-%d/%d", offset, end-1, large))
+	}
+
+	tests := []struct {
+		name     string
+		size     int
+		known    bool
+		requests []string
+	}{
+		{name: "small file", size: 10, known: true, requests: []string{"PUT content"}},
+		{name: "small file of unknown size", size: 10, requests: []string{"PUT content"}},
+		{name: "empty file", size: 0, known: true, requests: []string{"PUT content"}},
+		{name: "large file", size: large, known: true, requests: ranges},
+		{name: "large file of unknown size", size: large, requests: ranges},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeGraph(t)
+			defer srv.Close()
+
+			data := bytes.Repeat([]byte("x"), tt.size)
+			size := int64(-1)
+			if tt.known {
+				size = int64(tt.size)
+			}
+
+			c := &Client{Token: "access", BaseURL: srv.URL, ChunkSize: int64(chunk)}
+			item, err := c.Upload(context.Background(), "backup.xml", bytes.NewReader(data), size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item.Size != int64(tt.size) || !bytes.Equal(fake.files["backup.xml"], data) {
+				t.Errorf("uploaded %d bytes, want %d", item.Size, tt.size)
+			}
+			if strings.Join(fake.requests, ", ") != strings.Join(tt.requests, ", ") {
+				t.Errorf("requests = %v, want %v", fake.requests, tt.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package onedrive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// Name is the cloud name onedrive destinations are registered under
+const Name = "OneDrive"
+
+func init() {
+	storage.Register(Name, open)
+}
+
+// Connect exchanges an authorization code for a refresh token and makes sure
+// the app folder can be reached, returning the cloud to store for the user
+func Connect(ctx context.Context, code string) (*user.Cloud, error) {
+	accessToken, cloud, err := GetOneDriveTokens(code, "authorization_code")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = NewClient(accessToken).Children(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cloud, nil
+}
+
+// destination stores backups in the app folder of the user's onedrive
+type destination struct {
+	client *Client
+}
+
+// open refreshes the access token, updating the cloud with the rotated refresh token
+func open(_ context.Context, _ *user.User, c *user.Cloud) (storage.Destination, error) {
+	accessToken, refreshed, err := GetOneDriveTokens(c.Token, "refresh_token")
+	if err != nil {
+		return nil, err
+	}
+	if refreshed.Token != "" {
+		c.Token = refreshed.Token
+	}
+
+	return &destination{client: NewClient(accessToken)}, nil
+}
+
+func (d *destination) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	_, err := d.client.Upload(ctx, safeName(name), r, size)
+	return err
+}
+
+func (d *destination) List(ctx context.Context) ([]storage.FileInfo, error) {
+	items, err := d.client.Children(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storage.FileInfo, 0, len(items))
+	for _, item := range items {
+		files = append(files, storage.FileInfo{Name: item.Name, Size: item.Size, Modified: item.LastModifiedDateTime})
+	}
+	return files, nil
+}
+
+func (d *destination) Delete(ctx context.Context, name string) error {
+	return notFound(d.client.DeleteItem(ctx, safeName(name)))
+}
+
+func (d *destination) Stat(ctx context.Context, name string) (*storage.FileInfo, error) {
+	item, err := d.client.GetItem(ctx, safeName(name))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &storage.FileInfo{Name: item.Name, Size: item.Size, Modified: item.LastModifiedDateTime}, nil
+}
+
+func (d *destination) Quota(ctx context.Context) (*storage.Quota, error) {
+	quota, err := d.client.GetQuota(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Quota{Used: quota.Used, Total: quota.Total}, nil
+}
+
+// safeName replaces characters onedrive doesn't allow in file names, such as
+// the colons in backup timestamps. Names from List are left unchanged.
+var safeName = strings.NewReplacer(
+	":", "-",
+	`"`, "_", "*", "_", "<", "_", ">", "_", "?", "_", "/", "_", `\`, "_", "|", "_",
+).Replace
+
+func notFound(err error) error {
+	if errors.Is(err, ErrItemNotFound) {
+		return storage.ErrNotFound
+	}
+	return err
+}
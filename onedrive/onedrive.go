@@ -0,0 +1,91 @@
+package onedrive
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// TokenURL is the microsoft identity platform token endpoint, overridable for testing
+var TokenURL = "https://login.microsoftonline.com/common/oauth2/v2.0/token"
+
+// scope limits access to the app's own folder in the user's drive
+const scope = "Files.ReadWrite.AppFolder offline_access"
+
+type microsoftResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	Scope        string `json:"scope"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// GetOneDriveTokens gets access and refresh tokens from microsoft. Refresh
+// tokens are rotated on every use, so the returned cloud must be saved.
+func GetOneDriveTokens(code string, grantType string) (string, *user.Cloud, error) {
+
+	clientID := os.Getenv("ONEDRIVECLIENTID")
+	clientSecret := os.Getenv("ONEDRIVESECRET")
+
+	client := &http.Client{}
+
+	data := url.Values{}
+	data.Set("grant_type", grantType)
+	data.Set("client_id", clientID)
+	data.Set("client_secret", clientSecret)
+	data.Set("scope", scope)
+	if grantType == "authorization_code" {
+		data.Set("redirect_uri", "https://toodlebackup.com/onedriveredirect")
+		data.Set("code", code)
+	} else if grantType == "refresh_token" {
+		data.Set("refresh_token", code)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, TokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer resp.Body.Close()
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		log.Println(string(bytes))
+		return "", nil, &APIError{StatusCode: resp.StatusCode, Message: "request to connect onedrive failed"}
+	}
+
+	var microsoftResp microsoftResponse
+	json.Unmarshal(bytes, &microsoftResp)
+
+	return microsoftResp.AccessToken, responseToCloud(&microsoftResp), nil
+}
+
+func responseToCloud(resp *microsoftResponse) *user.Cloud {
+
+	token := resp.RefreshToken
+
+	return &user.Cloud{
+		Name:  Name,
+		Token: token,
+	}
+
+}
@@ -0,0 +1,137 @@
+package retention
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// DeltaSuffix ends the name of a backup holding only what changed since the
+// one before it, which can't be restored without the full backup it builds on
+const DeltaSuffix = " delta.xml"
+
+// Enabled reports whether the policy would ever delete anything
+func Enabled(p *user.Retention) bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+// Select returns the files the policy no longer wants to keep. A full backup
+// and the deltas after it are kept or removed together, as a chain dated by
+// its newest file. A chain is kept if it is one of the KeepLast newest, or the
+// newest chain of its day, week or month while that period is within the
+// policy's window. The newest chain is always kept.
+func Select(files []storage.FileInfo, p *user.Retention, now time.Time) []storage.FileInfo {
+	if !Enabled(p) || len(files) == 0 {
+		return nil
+	}
+
+	now = now.UTC()
+	today := startOfDay(now)
+	dailyCutoff := today.AddDate(0, 0, -p.KeepDaily+1)
+	weeklyCutoff := startOfWeek(today).AddDate(0, 0, -7*(p.KeepWeekly-1))
+	monthlyCutoff := time.Date(now.Year(), now.Month()-time.Month(p.KeepMonthly-1), 1, 0, 0, 0, 0, time.UTC)
+
+	days := make(map[time.Time]bool)
+	weeks := make(map[time.Time]bool)
+	months := make(map[time.Time]bool)
+
+	var remove []storage.FileInfo
+	for i, c := range chains(files) {
+		t := c[0].Modified.UTC()
+		keep := i == 0 || i < p.KeepLast
+
+		// Chains are newest first so the first one seen in a period is its newest
+		day := startOfDay(t)
+		if p.KeepDaily > 0 && !days[day] && !day.Before(dailyCutoff) {
+			keep = true
+		}
+		days[day] = true
+
+		week := startOfWeek(day)
+		if p.KeepWeekly > 0 && !weeks[week] && !week.Before(weeklyCutoff) {
+			keep = true
+		}
+		weeks[week] = true
+
+		month := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if p.KeepMonthly > 0 && !months[month] && !month.Before(monthlyCutoff) {
+			keep = true
+		}
+		months[month] = true
+
+		if !keep {
+			remove = append(remove, c...)
+		}
+	}
+	return remove
+}
+
+// chains groups files into full backups followed by their deltas, newest
+// first with each chain's files newest first. Deltas older than every full
+// backup make a chain of their own.
+func chains(files []storage.FileInfo) [][]storage.FileInfo {
+	sorted := make([]storage.FileInfo, len(files))
+	copy(sorted, files)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Modified.After(sorted[j].Modified)
+	})
+
+	var cs [][]storage.FileInfo
+	var c []storage.FileInfo
+	for _, f := range sorted {
+		c = append(c, f)
+		if !strings.HasSuffix(f.Name, DeltaSuffix) {
+			cs = append(cs, c)
+			c = nil
+		}
+	}
+	if len(c) > 0 {
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// Apply lists the backups at dest whose names start with prefix, so files
+// not made by us are left alone, and deletes those the policy doesn't keep.
+// It returns the names of the deleted files.
+func Apply(ctx context.Context, dest storage.Destination, prefix string, p *user.Retention, now time.Time) ([]string, error) {
+	if !Enabled(p) {
+		return nil, nil
+	}
+
+	files, err := dest.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := files[:0]
+	for _, f := range files {
+		if strings.HasPrefix(f.Name, prefix) {
+			backups = append(backups, f)
+		}
+	}
+
+	var deleted []string
+	for _, f := range Select(backups, p, now) {
+		err = dest.Delete(ctx, f.Name)
+		if err != nil && err != storage.ErrNotFound {
+			return deleted, err
+		}
+		deleted = append(deleted, f.Name)
+	}
+	return deleted, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// startOfWeek returns the monday of the week containing day
+func startOfWeek(day time.Time) time.Time {
+	offset := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -offset)
+}
@@ -0,0 +1,134 @@
+package retention
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+func at(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// files makes a file with each name, modified at the time the name starts with
+func files(names ...string) []storage.FileInfo {
+	var fs []storage.FileInfo
+	for _, n := range names {
+		fs = append(fs, storage.FileInfo{Name: n, Modified: at(n[:16])})
+	}
+	return fs
+}
+
+func names(fs []storage.FileInfo) []string {
+	var ns []string
+	for _, f := range fs {
+		ns = append(ns, f.Name)
+	}
+	return ns
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy user.Retention
+		now    string
+		files  []storage.FileInfo
+		remove []string
+	}{
+		{
+			name:   "disabled keeps everything",
+			policy: user.Retention{},
+			now:    "2024-01-10 12:00",
+			files:  files("2024-01-10 09:00", "2023-01-01 09:00"),
+		},
+		{
+			name:   "keep last",
+			policy: user.Retention{KeepLast: 2},
+			now:    "2024-01-10 12:00",
+			files:  files("2024-01-07 09:00", "2024-01-10 09:00", "2024-01-08 09:00", "2024-01-09 09:00"),
+			remove: []string{"2024-01-08 09:00", "2024-01-07 09:00"},
+		},
+		{
+			name:   "newest is always kept",
+			policy: user.Retention{KeepDaily: 1},
+			now:    "2024-01-10 12:00",
+			files:  files("2023-06-01 09:00", "2023-05-01 09:00"),
+			remove: []string{"2023-05-01 09:00"},
+		},
+		{
+			name:   "keep daily keeps the newest of each day",
+			policy: user.Retention{KeepDaily: 3},
+			now:    "2024-01-10 12:00",
+			files:  files("2024-01-10 09:00", "2024-01-10 03:00", "2024-01-09 09:00", "2024-01-08 23:59", "2024-01-07 09:00"),
+			remove: []string{"2024-01-10 03:00", "2024-01-07 09:00"},
+		},
+		{
+			// On a monday the previous week is the only other one kept
+			name:   "keep weekly counts back from monday",
+			policy: user.Retention{KeepWeekly: 2},
+			now:    "2024-01-08 12:00",
+			files:  files("2024-01-08 09:00", "2024-01-07 09:00", "2024-01-02 09:00", "2023-12-31 09:00"),
+			remove: []string{"2024-01-02 09:00", "2023-12-31 09:00"},
+		},
+		{
+			name:   "keep monthly across a year boundary",
+			policy: user.Retention{KeepMonthly: 3},
+			now:    "2024-02-15 12:00",
+			files:  files("2024-02-10 09:00", "2024-01-20 09:00", "2024-01-05 09:00", "2023-12-31 09:00", "2023-12-01 09:00", "2023-11-30 09:00"),
+			remove: []string{"2024-01-05 09:00", "2023-12-01 09:00", "2023-11-30 09:00"},
+		},
+		{
+			name:   "policies combine",
+			policy: user.Retention{KeepLast: 1, KeepDaily: 2, KeepMonthly: 2},
+			now:    "2024-03-05 12:00",
+			files:  files("2024-03-05 09:00", "2024-03-04 09:00", "2024-03-03 09:00", "2024-02-20 09:00", "2024-02-10 09:00", "2024-01-31 09:00"),
+			remove: []string{"2024-03-03 09:00", "2024-02-10 09:00", "2024-01-31 09:00"},
+		},
+		{
+			name:   "deltas keep the full they build on",
+			policy: user.Retention{KeepLast: 3},
+			now:    "2024-01-05 12:00",
+			files: files("2024-01-01 09:00", "2024-01-02 09:00 delta.xml", "2024-01-03 09:00 delta.xml",
+				"2024-01-04 09:00 delta.xml", "2024-01-05 09:00 delta.xml"),
+		},
+		{
+			name:   "a full is removed with its deltas",
+			policy: user.Retention{KeepLast: 1},
+			now:    "2024-01-07 12:00",
+			files: files("2024-01-01 09:00", "2024-01-02 09:00 delta.xml", "2024-01-03 09:00 delta.xml",
+				"2024-01-06 09:00", "2024-01-07 09:00 delta.xml"),
+			remove: []string{"2024-01-03 09:00 delta.xml", "2024-01-02 09:00 delta.xml", "2024-01-01 09:00"},
+		},
+		{
+			name:   "chains are dated by their newest file",
+			policy: user.Retention{KeepDaily: 2},
+			now:    "2024-01-10 12:00",
+			files: files("2024-01-01 09:00", "2024-01-09 09:00 delta.xml", "2024-01-10 08:00",
+				"2024-01-10 09:00 delta.xml", "2023-12-01 09:00"),
+			remove: []string{"2023-12-01 09:00"},
+		},
+		{
+			name:   "deltas without a full are a chain of their own",
+			policy: user.Retention{KeepLast: 1},
+			now:    "2024-01-10 12:00",
+			files:  files("2024-01-01 09:00 delta.xml", "2024-01-02 09:00 delta.xml", "2024-01-05 09:00", "2024-01-06 09:00 delta.xml"),
+			remove: []string{"2024-01-02 09:00 delta.xml", "2024-01-01 09:00 delta.xml"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := names(Select(tt.files, &tt.policy, at(tt.now)))
+			if !reflect.DeepEqual(got, tt.remove) {
+				t.Errorf("Select() removed %v, want %v", got, tt.remove)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Policy decides how many times to try an operation and how long to wait in
+// between. Each wait is a random time up to Base doubled for every attempt so
+// far, capped at Max, so retries from many backups don't line up.
+type Policy struct {
+	Attempts int
+	Base     time.Duration
+	Max      time.Duration
+}
+
+// Default tries an operation four times, waiting up to 2, 4 and 8 seconds in between
+var Default = Policy{Attempts: 4, Base: 2 * time.Second, Max: 30 * time.Second}
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// temporary is implemented by errors that may go away if the operation is retried
+type temporary interface {
+	Temporary() bool
+}
+
+// permanentError marks an error that must not be retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err so it is never retried, whatever it wraps
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsTransient reports whether err may succeed if retried: server errors and
+// rate limits reported through a Temporary method, timeouts and dropped
+// connections. Anything else, such as a revoked token, is permanent.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var perm *permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var t temporary
+	if errors.As(err, &t) {
+		if _, isNet := t.(net.Error); !isNet {
+			return t.Temporary()
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// StatusTemporary reports whether a request that got an http response with
+// status code may succeed if retried, for rate limits and server errors
+func StatusTemporary(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// Do runs op until it succeeds, fails permanently, runs out of attempts or ctx
+// is cancelled, returning op's last error
+func Do(ctx context.Context, p Policy, op func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = op()
+		if err == nil || !IsTransient(err) || attempt+1 >= p.Attempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.Delay(attempt)):
+		}
+	}
+}
+
+// Delay returns how long to wait after the given attempt, counting from 0
+func (p Policy) Delay(attempt int) time.Duration {
+	backoff := p.Max
+	if attempt < 32 {
+		if d := p.Base << uint(attempt); d > 0 && d < p.Max {
+			backoff = d
+		}
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitter.Int63n(int64(backoff) + 1))
+}
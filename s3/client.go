@@ -0,0 +1,352 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/retry"
+)
+
+const (
+	// DefaultRegion is used when no region is configured
+	DefaultRegion = "us-east-1"
+
+	// minPartSize is the smallest part s3 accepts in a multipart upload
+	minPartSize int64 = 5 << 20
+
+	// DefaultPartSize is the size of each part in a multipart upload
+	DefaultPartSize int64 = 8 << 20
+)
+
+// ErrNoSuchKey is returned when an object does not exist
+var ErrNoSuchKey = errors.New("s3: no such key")
+
+// APIError describes an error response from an s3 compatible server
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("s3: status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is lets errors.Is match an APIError against ErrNoSuchKey
+func (e *APIError) Is(target error) bool {
+	return target == ErrNoSuchKey && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *APIError) Temporary() bool {
+	return retry.StatusTemporary(e.StatusCode)
+}
+
+// Object is an entry returned when listing a bucket
+type Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+// Client talks to a single bucket on an s3 compatible server. When Endpoint is
+// empty AWS is used with virtual-hosted addressing, otherwise requests are
+// made path-style which works for MinIO, Backblaze B2 and most others.
+type Client struct {
+	Endpoint   string
+	Region     string
+	Bucket     string
+	AccessKey  string
+	SecretKey  string
+	PartSize   int64
+	HTTPClient *http.Client
+}
+
+type errorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type listBucketResult struct {
+	Contents              []Object `xml:"Contents"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// HeadBucket checks the bucket exists and the credentials can access it
+func (c *Client) HeadBucket(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodHead, "", nil, nil, nil)
+	return err
+}
+
+// Upload writes size bytes from r to key, switching to a multipart upload
+// when the object is larger than the part size. A negative size means unknown.
+func (c *Client) Upload(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size >= 0 && size <= c.partSize() {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return c.PutObject(ctx, key, data)
+	}
+
+	uploadID, err := c.createMultipartUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	err = c.uploadParts(ctx, key, uploadID, r)
+	if err != nil {
+		// Don't leave orphaned parts around, they are billed for
+		c.abortMultipartUpload(context.Background(), key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) uploadParts(ctx context.Context, key string, uploadID string, r io.Reader) error {
+	buf := make([]byte, c.partSize())
+	var parts []completedPart
+
+	for partNumber := 1; ; partNumber++ {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+
+		// Every upload needs at least one part, even if it is empty
+		if n > 0 || len(parts) == 0 {
+			query := url.Values{}
+			query.Set("partNumber", strconv.Itoa(partNumber))
+			query.Set("uploadId", uploadID)
+
+			header, err := c.do(ctx, http.MethodPut, key, query, buf[:n], nil)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, completedPart{PartNumber: partNumber, ETag: header.Get("ETag")})
+		}
+
+		if last {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+	_, err = c.do(ctx, http.MethodPost, key, query, body, nil)
+	return err
+}
+
+// PutObject uploads data to key in a single request
+func (c *Client) PutObject(ctx context.Context, key string, data []byte) error {
+	_, err := c.do(ctx, http.MethodPut, key, nil, data, nil)
+	return err
+}
+
+// HeadObject returns the size and modification time of the object at key
+func (c *Client) HeadObject(ctx context.Context, key string) (*Object, error) {
+	header, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	modified, _ := http.ParseTime(header.Get("Last-Modified"))
+	return &Object{Key: key, Size: size, LastModified: modified}, nil
+}
+
+// DeleteObject removes the object at key
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	return err
+}
+
+// ListObjects returns every object directly under prefix
+func (c *Client) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("delimiter", "/")
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var res listBucketResult
+		_, err := c.do(ctx, http.MethodGet, "", query, nil, &res)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, res.Contents...)
+
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (c *Client) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+
+	var res initiateMultipartUploadResult
+	_, err := c.do(ctx, http.MethodPost, key, query, nil, &res)
+	if err != nil {
+		return "", err
+	}
+	return res.UploadID, nil
+}
+
+func (c *Client) abortMultipartUpload(ctx context.Context, key string, uploadID string) error {
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+	_, err := c.do(ctx, http.MethodDelete, key, query, nil, nil)
+	return err
+}
+
+// do sends a signed request for key (or the bucket when key is empty) and
+// decodes an xml response into out
+func (c *Client) do(ctx context.Context, method string, key string, query url.Values, body []byte, out interface{}) (http.Header, error) {
+	u, err := c.url(key, query)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+
+	hash := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(hash[:]), time.Now())
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errResp errorResponse
+		xml.Unmarshal(data, &errResp)
+		if errResp.Code == "" {
+			errResp.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, &APIError{StatusCode: resp.StatusCode, Code: errResp.Code, Message: errResp.Message}
+	}
+
+	// Some operations report errors inside a 200 response
+	if len(data) > 0 {
+		var errResp struct {
+			XMLName xml.Name
+			errorResponse
+		}
+		if xml.Unmarshal(data, &errResp) == nil && errResp.XMLName.Local == "Error" {
+			return nil, &APIError{StatusCode: resp.StatusCode, Code: errResp.Code, Message: errResp.Message}
+		}
+		if out != nil {
+			err = xml.Unmarshal(data, out)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return resp.Header, nil
+}
+
+// url builds the address of key, choosing path-style or virtual-hosted addressing
+func (c *Client) url(key string, query url.Values) (*url.URL, error) {
+	endpoint := c.Endpoint
+	pathStyle := true
+	if endpoint == "" {
+		endpoint = "https://s3." + c.region() + ".amazonaws.com"
+		pathStyle = false
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	p := strings.TrimSuffix(u.Path, "/")
+	if pathStyle {
+		p += "/" + c.Bucket
+	} else {
+		u.Host = c.Bucket + "." + u.Host
+	}
+	if key != "" || p == "" {
+		p += "/" + key
+	}
+
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+	return u, nil
+}
+
+func (c *Client) region() string {
+	if c.Region == "" {
+		return DefaultRegion
+	}
+	return c.Region
+}
+
+func (c *Client) partSize() int64 {
+	if c.PartSize < minPartSize {
+		return DefaultPartSize
+	}
+	return c.PartSize
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
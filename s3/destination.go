@@ -0,0 +1,136 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// Name is the cloud name s3 destinations are registered under
+const Name = "S3"
+
+func init() {
+	storage.Register(Name, open)
+}
+
+// Config describes how to reach a user's bucket
+type Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+// Connect checks the bucket can be reached with the given credentials and
+// returns the cloud to store for the user, with the secret key as its token
+func Connect(ctx context.Context, cfg *Config) (*user.Cloud, error) {
+	if cfg.Bucket == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("s3: bucket, access key and secret key are required")
+	}
+
+	err := newClient(cfg).HeadBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user.Cloud{
+		Name:  Name,
+		Token: cfg.SecretKey,
+		Config: map[string]string{
+			"endpoint":  cfg.Endpoint,
+			"region":    cfg.Region,
+			"bucket":    cfg.Bucket,
+			"prefix":    cfg.Prefix,
+			"accessKey": cfg.AccessKey,
+		},
+	}, nil
+}
+
+func newClient(cfg *Config) *Client {
+	return &Client{
+		Endpoint:  cfg.Endpoint,
+		Region:    cfg.Region,
+		Bucket:    cfg.Bucket,
+		AccessKey: cfg.AccessKey,
+		SecretKey: cfg.SecretKey,
+	}
+}
+
+// destination stores backups as objects under a prefix in a bucket
+type destination struct {
+	client *Client
+	prefix string
+}
+
+func open(_ context.Context, _ *user.User, c *user.Cloud) (storage.Destination, error) {
+	cfg := &Config{
+		Endpoint:  c.Config["endpoint"],
+		Region:    c.Config["region"],
+		Bucket:    c.Config["bucket"],
+		AccessKey: c.Config["accessKey"],
+		SecretKey: c.Token,
+	}
+
+	prefix := strings.Trim(c.Config["prefix"], "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &destination{client: newClient(cfg), prefix: prefix}, nil
+}
+
+func (d *destination) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	return d.client.Upload(ctx, d.prefix+name, r, size)
+}
+
+func (d *destination) List(ctx context.Context) ([]storage.FileInfo, error) {
+	objects, err := d.client.ListObjects(ctx, d.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storage.FileInfo, 0, len(objects))
+	for _, o := range objects {
+		files = append(files, storage.FileInfo{
+			Name:     strings.TrimPrefix(o.Key, d.prefix),
+			Size:     o.Size,
+			Modified: o.LastModified,
+		})
+	}
+	return files, nil
+}
+
+func (d *destination) Delete(ctx context.Context, name string) error {
+	return d.client.DeleteObject(ctx, d.prefix+name)
+}
+
+func (d *destination) Stat(ctx context.Context, name string) (*storage.FileInfo, error) {
+	o, err := d.client.HeadObject(ctx, d.prefix+name)
+	if errors.Is(err, ErrNoSuchKey) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &storage.FileInfo{Name: name, Size: o.Size, Modified: o.LastModified}, nil
+}
+
+// Quota reports the space taken by backups, buckets have no fixed size
+func (d *destination) Quota(ctx context.Context) (*storage.Quota, error) {
+	files, err := d.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var used int64
+	for _, f := range files {
+		used += f.Size
+	}
+	return &storage.Quota{Used: used}, nil
+}
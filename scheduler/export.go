@@ -0,0 +1,274 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/xml"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/history"
+	"github.com/jarota/ToodleBackupBackend/toodledo"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// section is one kind of item in a backup file, such as the user's tasks.
+// Total is how many items toodledo said there were, if it said, and
+// deletions the items deleted since the previous backup.
+type section struct {
+	XMLName   xml.Name
+	Num       int `xml:"num,attr,omitempty"`
+	Total     int `xml:"total,attr,omitempty"`
+	Items     interface{}
+	count     int
+	deletions []history.Deletion
+}
+
+// changes describes what has changed in toodledo since the previous backup.
+// A full backup fetches everything whether it has changed or not.
+type changes struct {
+	prev user.ToodleEdits
+	cur  user.ToodleEdits
+	full bool
+}
+
+// changed reports whether the edit picked by edit has changed, always true
+// for a full backup
+func (ch *changes) changed(edit func(user.ToodleEdits) int64) bool {
+	return ch.full || edit(ch.prev) != edit(ch.cur)
+}
+
+// since returns the time to fetch changes after, 0 for a full backup
+func (ch *changes) since(edit func(user.ToodleEdits) int64) int64 {
+	if ch.full {
+		return 0
+	}
+	return edit(ch.prev)
+}
+
+// fetchFunc fetches a section for a backup, returning a nil section if
+// nothing in it has changed
+type fetchFunc func(ctx context.Context, c *toodledo.Client, ch *changes) (*section, error)
+
+// sections fetch each kind of item from toodledo, keyed by the scope that
+// gives access to it
+var sections = map[string]fetchFunc{
+	"tasks": fetchTasks,
+	"notes": fetchNotes,
+	"folders": whole(func(e user.ToodleEdits) int64 { return e.Folder },
+		func(ctx context.Context, c *toodledo.Client) (interface{}, int, error) {
+			folders, err := c.Folders(ctx)
+			return folders, len(folders), err
+		}),
+	"contexts": whole(func(e user.ToodleEdits) int64 { return e.Context },
+		func(ctx context.Context, c *toodledo.Client) (interface{}, int, error) {
+			contexts, err := c.Contexts(ctx)
+			return contexts, len(contexts), err
+		}),
+	"goals": whole(func(e user.ToodleEdits) int64 { return e.Goal },
+		func(ctx context.Context, c *toodledo.Client) (interface{}, int, error) {
+			goals, err := c.Goals(ctx)
+			return goals, len(goals), err
+		}),
+	"locations": whole(func(e user.ToodleEdits) int64 { return e.Location },
+		func(ctx context.Context, c *toodledo.Client) (interface{}, int, error) {
+			locations, err := c.Locations(ctx)
+			return locations, len(locations), err
+		}),
+	"outlines": whole(func(e user.ToodleEdits) int64 { return e.Outline },
+		func(ctx context.Context, c *toodledo.Client) (interface{}, int, error) {
+			outlines, err := c.Outlines(ctx)
+			return outlines, len(outlines), err
+		}),
+	"lists": whole(func(e user.ToodleEdits) int64 { return e.List },
+		func(ctx context.Context, c *toodledo.Client) (interface{}, int, error) {
+			lists, err := c.Lists(ctx)
+			if err != nil {
+				return nil, 0, err
+			}
+			for i := range lists {
+				lists[i].Rows, err = c.Rows(ctx, lists[i].ID)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			return lists, len(lists), nil
+		}),
+	// Toodledo doesn't say when habits change, so they are always backed up
+	"habits": whole(nil,
+		func(ctx context.Context, c *toodledo.Client) (interface{}, int, error) {
+			habits, err := c.Habits(ctx)
+			return habits, len(habits), err
+		}),
+}
+
+// untracked are the sections toodledo doesn't say when they change, so a
+// backup is never skipped for having nothing new while they are backed up
+var untracked = map[string]bool{"habits": true}
+
+// tracksAll reports whether toodledo says when every section in toBackup
+// changes
+func tracksAll(toBackup []string) bool {
+	for _, s := range toBackup {
+		if untracked[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// deletions fetch the items toodledo remembers being deleted, keyed by the
+// scope of the items
+var deletions = map[string]fetchFunc{
+	"tasks": deleted("tasks", func(e user.ToodleEdits) int64 { return e.TaskDelete },
+		func(ctx context.Context, c *toodledo.Client, after int64) ([]toodledo.Deletion, error) {
+			return c.DeletedTasks(ctx, after)
+		}),
+	"notes": deleted("notes", func(e user.ToodleEdits) int64 { return e.NoteDelete },
+		func(ctx context.Context, c *toodledo.Client, after int64) ([]toodledo.Deletion, error) {
+			return c.DeletedNotes(ctx, after)
+		}),
+}
+
+// deleted makes a fetchFunc for the items of a scope that have been deleted,
+// a delta only has those deleted since the previous backup. Deletions newer
+// than the previous backup are also recorded in the run.
+func deleted(scope string, edit func(user.ToodleEdits) int64, fetch func(ctx context.Context, c *toodledo.Client, after int64) ([]toodledo.Deletion, error)) fetchFunc {
+	return func(ctx context.Context, c *toodledo.Client, ch *changes) (*section, error) {
+		if !ch.changed(edit) {
+			return nil, nil
+		}
+		items, err := fetch(ctx, c, ch.since(edit))
+		if err != nil {
+			return nil, err
+		}
+
+		sec := &section{Items: items, count: len(items)}
+		for _, item := range items {
+			if int64(item.Stamp) > edit(ch.prev) {
+				sec.deletions = append(sec.deletions, history.Deletion{
+					Scope:   scope,
+					ID:      int64(item.ID),
+					Deleted: time.Unix(int64(item.Stamp), 0).UTC(),
+				})
+			}
+		}
+		return sec, nil
+	}
+}
+
+// whole makes a fetchFunc for items toodledo can only send all of, which are
+// left out of a delta unless the edit picked by edit has changed. A nil edit
+// means they are always fetched.
+func whole(edit func(user.ToodleEdits) int64, fetch func(ctx context.Context, c *toodledo.Client) (interface{}, int, error)) fetchFunc {
+	return func(ctx context.Context, c *toodledo.Client, ch *changes) (*section, error) {
+		if edit != nil && !ch.changed(edit) {
+			return nil, nil
+		}
+		items, n, err := fetch(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return &section{Items: items, count: n}, nil
+	}
+}
+
+// fetchTasks fetches every active and completed task, or for a delta every
+// task modified since the previous backup. A task completed while they are
+// being fetched may be returned twice, so only the first is kept.
+func fetchTasks(ctx context.Context, c *toodledo.Client, ch *changes) (*section, error) {
+	edit := func(e user.ToodleEdits) int64 { return e.Task }
+	if !ch.changed(edit) {
+		return nil, nil
+	}
+
+	var pages []*toodledo.TaskPage
+	completions := []toodledo.Completion{toodledo.IncompleteTasks, toodledo.CompletedTasks}
+	if !ch.full {
+		completions = []toodledo.Completion{toodledo.AllTasks}
+	}
+	for _, completion := range completions {
+		page, err := c.FetchAllTasks(ctx, toodledo.TaskQuery{
+			Fields:     toodledo.TaskFields,
+			Completion: completion,
+			ModAfter:   ch.since(edit),
+		})
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+
+	seen := map[toodledo.Int]bool{}
+	var tasks []toodledo.Task
+	total := 0
+	for _, page := range pages {
+		total += page.Total
+		for _, task := range page.Tasks {
+			if !seen[task.ID] {
+				seen[task.ID] = true
+				tasks = append(tasks, task)
+			}
+		}
+	}
+	return &section{Num: len(tasks), Total: total, Items: tasks, count: len(tasks)}, nil
+}
+
+// fetchNotes fetches every note, or for a delta every note modified since the
+// previous backup
+func fetchNotes(ctx context.Context, c *toodledo.Client, ch *changes) (*section, error) {
+	edit := func(e user.ToodleEdits) int64 { return e.Note }
+	if !ch.changed(edit) {
+		return nil, nil
+	}
+	page, err := c.FetchAllNotes(ctx, toodledo.NoteQuery{ModAfter: ch.since(edit)})
+	if err != nil {
+		return nil, err
+	}
+	return &section{Num: page.Num, Total: page.Total, Items: page.Notes, count: len(page.Notes)}, nil
+}
+
+// accountEdits picks out when each kind of item was last changed
+func accountEdits(a *toodledo.Account) user.ToodleEdits {
+	return user.ToodleEdits{
+		Folder:     int64(a.LastEditFolder),
+		Context:    int64(a.LastEditContext),
+		Goal:       int64(a.LastEditGoal),
+		Location:   int64(a.LastEditLocation),
+		Task:       int64(a.LastEditTask),
+		TaskDelete: int64(a.LastDeleteTask),
+		Note:       int64(a.LastEditNote),
+		NoteDelete: int64(a.LastDeleteNote),
+		List:       int64(a.LastEditList),
+		Outline:    int64(a.LastEditOutline),
+	}
+}
+
+// startBackupFile writes the opening of a backup file, which is closed by
+// enc.EncodeToken(root.End()). A delta is applied on top of the full backup
+// and any deltas before it by replacing items with the same id, then removing
+// the deleted ones.
+func startBackupFile(enc *xml.Encoder, kind history.Kind, exported time.Time) (xml.StartElement, error) {
+	root := xml.StartElement{Name: xml.Name{Local: "xml"}}
+	err := enc.EncodeToken(root)
+	if err != nil {
+		return root, err
+	}
+
+	fields := []struct {
+		name  string
+		value interface{}
+	}{
+		{"title", "Toodledo :: XML Backup"},
+		{"link", "http://www.toodledo.com/"},
+		{"toodledoversion", 20},
+		{"description", "Your Toodledo backup"},
+		{"export_date", exported.Unix()},
+		{"backup_type", kind},
+	}
+	for _, field := range fields {
+		err = enc.EncodeElement(field.value, xml.StartElement{Name: xml.Name{Local: field.name}})
+		if err != nil {
+			return root, err
+		}
+	}
+	return root, nil
+}
@@ -0,0 +1,84 @@
+package scheduler
+
+import (
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/cron"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// NextRun returns the first time strictly after after that the user's data
+// should be backed up, in UTC. The backup time is read in the user's timezone,
+// so backups keep to the same local time when daylight saving time changes.
+// A cron expression takes priority over the frequency, and users without
+// either are backed up daily.
+func NextRun(u *user.User, after time.Time) time.Time {
+	loc := u.Location()
+	after = after.In(loc)
+	bt := u.Time
+
+	if u.Cron != "" {
+		schedule, err := cron.Parse(u.Cron)
+		if err == nil {
+			if next := schedule.Next(after); !next.IsZero() {
+				return next.UTC()
+			}
+		}
+	}
+
+	// Whole days are counted on a calendar date, so they always step by one
+	// day no matter how long the local day is
+	today := time.Date(after.Year(), after.Month(), after.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch u.Frequency {
+	case user.Hourly:
+		next := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), bt.Minute, bt.Second, 0, loc)
+		for !next.After(after) {
+			next = next.Add(time.Hour)
+		}
+		return next.UTC()
+
+	case user.Weekly:
+		day := today.AddDate(0, 0, (int(bt.Weekday)-int(today.Weekday())+7)%7)
+		next := atTime(day, bt, loc)
+		if !next.After(after) {
+			next = atTime(day.AddDate(0, 0, 7), bt, loc)
+		}
+		return next.UTC()
+
+	case user.Monthly:
+		for month := 0; ; month++ {
+			first := time.Date(today.Year(), today.Month()+time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+			next := atTime(first.AddDate(0, 0, monthDay(first, bt.Day)-1), bt, loc)
+			if next.After(after) {
+				return next.UTC()
+			}
+		}
+
+	default:
+		next := atTime(today, bt, loc)
+		if !next.After(after) {
+			next = atTime(today.AddDate(0, 0, 1), bt, loc)
+		}
+		return next.UTC()
+	}
+}
+
+// atTime returns the backup time in loc on the calendar date of day, with
+// daylight saving changes handled the same way as cron expressions
+func atTime(day time.Time, bt user.BackupTime, loc *time.Location) time.Time {
+	return cron.Date(day.Year(), day.Month(), day.Day(), bt.Hour, bt.Minute, bt.Second, loc)
+}
+
+// monthDay clamps day to the length of the month starting at first, so
+// backups on the 31st happen on the last day of shorter months
+func monthDay(first time.Time, day int) int {
+	if day < 1 {
+		return 1
+	}
+	last := first.AddDate(0, 1, -1).Day()
+	if day > last {
+		return last
+	}
+	return day
+}
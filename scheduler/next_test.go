@@ -0,0 +1,137 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+func TestNextRun(t *testing.T) {
+	newYork := "America/New_York"
+
+	tests := []struct {
+		name  string
+		user  user.User
+		after time.Time
+		want  time.Time
+	}{
+		{
+			name:  "daily later today",
+			user:  user.User{Frequency: user.Daily, Time: user.BackupTime{Hour: 9}},
+			after: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "daily tomorrow",
+			user:  user.User{Frequency: user.Daily, Time: user.BackupTime{Hour: 9}},
+			after: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "daily in the user's timezone",
+			user:  user.User{Frequency: user.Daily, Time: user.BackupTime{Hour: 9}, Timezone: newYork},
+			after: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "daily keeps local time after the clocks go forward",
+			user:  user.User{Frequency: user.Daily, Time: user.BackupTime{Hour: 9}, Timezone: newYork},
+			after: time.Date(2024, 3, 9, 15, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 3, 10, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "skipped time runs when the clocks go forward",
+			user:  user.User{Frequency: user.Daily, Time: user.BackupTime{Hour: 2, Minute: 30}, Timezone: newYork},
+			after: time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "repeated time runs the first time",
+			user:  user.User{Frequency: user.Daily, Time: user.BackupTime{Hour: 1, Minute: 30}, Timezone: newYork},
+			after: time.Date(2024, 11, 3, 4, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "repeated time doesn't run the second time",
+			user:  user.User{Frequency: user.Daily, Time: user.BackupTime{Hour: 1, Minute: 30}, Timezone: newYork},
+			after: time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC),
+			want:  time.Date(2024, 11, 4, 6, 30, 0, 0, time.UTC),
+		},
+		{
+			name:  "hourly",
+			user:  user.User{Frequency: user.Hourly, Time: user.BackupTime{Minute: 15}},
+			after: time.Date(2024, 1, 1, 10, 20, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 1, 11, 15, 0, 0, time.UTC),
+		},
+		{
+			name:  "weekly next week",
+			user:  user.User{Frequency: user.Weekly, Time: user.BackupTime{Hour: 9, Weekday: time.Monday}},
+			after: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "weekly later this week",
+			user:  user.User{Frequency: user.Weekly, Time: user.BackupTime{Hour: 9, Weekday: time.Saturday}},
+			after: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 6, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "monthly clamps to the end of february",
+			user:  user.User{Frequency: user.Monthly, Time: user.BackupTime{Hour: 9, Day: 31}},
+			after: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 2, 29, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "monthly clamps to the end of a 30 day month",
+			user:  user.User{Frequency: user.Monthly, Time: user.BackupTime{Hour: 9, Day: 31}},
+			after: time.Date(2024, 3, 31, 10, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 4, 30, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "monthly across a year boundary",
+			user:  user.User{Frequency: user.Monthly, Time: user.BackupTime{Hour: 9, Day: 15}},
+			after: time.Date(2024, 12, 20, 0, 0, 0, 0, time.UTC),
+			want:  time.Date(2025, 1, 15, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "cron takes priority over frequency",
+			user:  user.User{Frequency: user.Hourly, Cron: "0 6 * * *", Timezone: newYork},
+			after: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 2, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "invalid cron falls back to frequency",
+			user:  user.User{Frequency: user.Daily, Cron: "nonsense", Time: user.BackupTime{Hour: 9}},
+			after: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC),
+			want:  time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NextRun(&tt.user, tt.after)
+			if !got.Equal(tt.want) {
+				t.Errorf("NextRun(%v) = %v, want %v", tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatestMissed(t *testing.T) {
+	u := &user.User{Frequency: user.Daily, Time: user.BackupTime{Hour: 2}}
+
+	// Down from monday 01:00 to wednesday 10:00, wednesday's run was the last missed
+	scheduled := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	now := time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC)
+	want := time.Date(2024, 1, 3, 2, 0, 0, 0, time.UTC)
+	if got := latestMissed(u, scheduled, now); !got.Equal(want) {
+		t.Errorf("latestMissed() = %v, want %v", got, want)
+	}
+
+	// Only one run missed
+	now = time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	if got := latestMissed(u, scheduled, now); !got.Equal(scheduled) {
+		t.Errorf("latestMissed() = %v, want %v", got, scheduled)
+	}
+}
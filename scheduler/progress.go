@@ -0,0 +1,66 @@
+package scheduler
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/jarota/ToodleBackupBackend/jobs"
+)
+
+// progressInterval is the most often a job's progress is saved, unless it
+// has moved on to a new step
+const progressInterval = time.Second
+
+// Reporter is told what a backup is doing as it goes
+type Reporter func(progress jobs.Progress)
+
+// report passes progress on, if anyone is listening
+func (r Reporter) report(stage string, detail string, percent int) {
+	if r != nil {
+		r(jobs.Progress{Stage: stage, Detail: detail, Percent: percent})
+	}
+}
+
+// jobReporter saves a job's progress to mongodb, at most once a second
+// within each step
+func jobReporter(ctx context.Context, dbc *mongo.Client, job *jobs.Job) Reporter {
+	var last jobs.Progress
+	var saved time.Time
+	return func(progress jobs.Progress) {
+		if progress == last {
+			return
+		}
+		sameStep := progress.Stage == last.Stage && progress.Detail == last.Detail
+		if sameStep && progress.Percent < 100 && time.Since(saved) < progressInterval {
+			return
+		}
+
+		err := job.SetProgress(ctx, dbc, progress)
+		if err != nil {
+			log.Printf("Error saving progress of backup job %s: %v\n", job.ID.Hex(), err)
+			return
+		}
+		last, saved = progress, time.Now()
+	}
+}
+
+// progressReader reports how much of a file has been read as it is uploaded
+type progressReader struct {
+	r      io.Reader
+	read   int64
+	size   int64
+	onRead func(percent int)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.size > 0 {
+		p.onRead(int(p.read * 100 / p.size))
+	}
+	return n, err
+}
@@ -2,17 +2,24 @@ package scheduler
 
 import (
 	"context"
+	"encoding/xml"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"time"
 
 	"github.com/jarota/ToodleBackupBackend/db"
-	"github.com/jarota/ToodleBackupBackend/dropbox"
+	"github.com/jarota/ToodleBackupBackend/history"
+	"github.com/jarota/ToodleBackupBackend/jobs"
+	"github.com/jarota/ToodleBackupBackend/lease"
+	"github.com/jarota/ToodleBackupBackend/limits"
+	"github.com/jarota/ToodleBackupBackend/localfs"
+	"github.com/jarota/ToodleBackupBackend/retention"
+	"github.com/jarota/ToodleBackupBackend/retry"
+	"github.com/jarota/ToodleBackupBackend/storage"
 	"github.com/jarota/ToodleBackupBackend/toodledo"
 	"github.com/jarota/ToodleBackupBackend/user"
 	"go.mongodb.org/mongo-driver/bson"
@@ -20,171 +27,614 @@ import (
 )
 
 const (
-	taskFields = "folder, context, goal, location, tag, startdate, duedate, duedatemod, starttime, duetime, remind, repeat, status, star, priority, length, timer, added, note, parent, children, order, meta, previous, attachment, shared, addedby, via, attachments"
+	// pollInterval is how often the scheduler looks for users to back up
+	pollInterval = 60 * time.Second
+
+	// schedulerLease names the lease held by the instance doing the scheduling
+	schedulerLease = "scheduler"
 )
 
-// PollForPendingBackups continuously pings mongodb for users to backup
+// DefaultCatchUpWindow is how late a missed backup can be and still run, when
+// CATCHUPWINDOW isn't set
+const DefaultCatchUpWindow = 24 * time.Hour
+
+// DefaultFullBackupInterval is how often a full backup is taken, with deltas
+// in between, when FULLBACKUPINTERVAL isn't set
+const DefaultFullBackupInterval = 7 * 24 * time.Hour
+
+// PollForPendingBackups continuously pings mongodb for users to backup, until
+// ctx is cancelled. When several instances of the backend are running only
+// the one holding the scheduler lease polls, and another takes over if it
+// stops renewing it.
 func PollForPendingBackups(ctx context.Context, dbc *mongo.Client) {
-	for {
-		h, m, _ := time.Now().UTC().Clock()
-		// log.Printf("Polling database at %d:%d...", h, m)
+	holder := jobs.WorkerID()
+	leader := false
+
+	for ctx.Err() == nil {
+		held, err := lease.Acquire(ctx, dbc, schedulerLease, holder, 3*pollInterval)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Error acquiring scheduler lease: %v\n", err)
+			held = false
+		}
+		if held != leader {
+			leader = held
+			if leader {
+				log.Printf("%s is now scheduling backups\n", holder)
+			} else {
+				log.Printf("%s is no longer scheduling backups\n", holder)
+			}
+		}
 
-		userCollection, err := db.GetCollection(dbc, "ToodleBackup", "Users")
+		if leader {
+			err = runPendingBackups(ctx, dbc, time.Now().UTC())
+			if err != nil {
+				log.Printf("Error polling database for users to backup: %v\n", err)
+			}
+		}
+
+		// Pause backing up for one minute
+		select {
+		case <-ctx.Done():
+		case <-time.After(pollInterval):
+		}
+	}
+
+	// Let another instance take over without waiting for the lease to expire
+	if leader {
+		err := lease.Release(context.Background(), dbc, schedulerLease, holder)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Error releasing scheduler lease: %v\n", err)
 		}
+	}
+}
 
-		filter := bson.D{{Key: "time.hour", Value: h}, {Key: "time.minute", Value: m}}
+// CatchUpWindow returns how long after its scheduled time a missed backup,
+// say from the server being down, will still be run. It is read from
+// CATCHUPWINDOW, such as "6h", and 0 means missed backups always run.
+func CatchUpWindow() time.Duration {
+	s := os.Getenv("CATCHUPWINDOW")
+	if s == "" {
+		return DefaultCatchUpWindow
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil || window < 0 {
+		log.Printf("Invalid CATCHUPWINDOW %q, using %v\n", s, DefaultCatchUpWindow)
+		return DefaultCatchUpWindow
+	}
+	return window
+}
 
-		cursor, err := userCollection.Find(ctx, filter)
+// FullBackupInterval returns how long after a full backup the next one is
+// taken, backups in between only hold what has changed. It is read from
+// FULLBACKUPINTERVAL, such as "72h", and 0 means every backup is full.
+func FullBackupInterval() time.Duration {
+	s := os.Getenv("FULLBACKUPINTERVAL")
+	if s == "" {
+		return DefaultFullBackupInterval
+	}
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval < 0 {
+		log.Printf("Invalid FULLBACKUPINTERVAL %q, using %v\n", s, DefaultFullBackupInterval)
+		return DefaultFullBackupInterval
+	}
+	return interval
+}
+
+// runPendingBackups starts a backup for every user whose next run has come,
+// including runs missed while the server was down, and schedules users who
+// have never had a next run computed
+func runPendingBackups(ctx context.Context, dbc *mongo.Client, now time.Time) error {
+	userCollection, err := db.GetCollection(dbc, "ToodleBackup", "Users")
+	if err != nil {
+		return err
+	}
+	window := CatchUpWindow()
+
+	filter := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "nextrun", Value: bson.D{{Key: "$lte", Value: now}}}},
+		bson.D{{Key: "nextrun", Value: bson.D{{Key: "$exists", Value: false}}}},
+	}}}
+
+	cursor, err := userCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var u user.User
+		err := cursor.Decode(&u)
 		if err != nil {
-			log.Fatal("Error polling database for users to backup")
+			log.Printf("Error decoding user for backup: %v\n", err)
+			continue
 		}
-		defer cursor.Close(ctx)
 
-		for cursor.Next(ctx) {
-			var u user.User
-			err := cursor.Decode(&u)
-			if err != nil {
-				log.Fatal("Error decoding user for backup")
-			}
+		// Users from before next runs were stored are due if a backup should
+		// have happened since their last successful one
+		scheduled := u.NextRun
+		if scheduled.IsZero() && !u.LastSuccess.IsZero() {
+			scheduled = NextRun(&u, u.LastSuccess)
+		}
+		due := !scheduled.IsZero() && !scheduled.After(now)
+
+		if due && window > 0 && now.Sub(latestMissed(&u, scheduled, now)) > window {
+			log.Printf("Skipping backup for %s missed since %v\n", u.Username, scheduled)
+			due = false
+		}
 
-			if len(u.Clouds) > 0 && len(u.Toodledo.ToBackup) > 0 {
-				go BackupUserData(ctx, dbc, &u)
+		claimed, err := reschedule(ctx, userCollection, &u, now)
+		if err != nil {
+			log.Printf("Error scheduling next backup for %s: %v\n", u.Username, err)
+			continue
+		}
+
+		if due && claimed && hasBackups(&u) {
+			_, err = jobs.Enqueue(ctx, dbc, u.Username, history.TriggerScheduled)
+			if err != nil {
+				log.Printf("Error queueing backup for %s: %v\n", u.Username, err)
 			}
 		}
-		if err := cursor.Err(); err != nil {
-			log.Fatal(err)
+	}
+	return cursor.Err()
+}
+
+// latestMissed returns the most recent run up to now, starting from a run
+// that was missed at scheduled, so how late a backup is counts from the last
+// run it missed rather than the first
+func latestMissed(u *user.User, scheduled time.Time, now time.Time) time.Time {
+	for {
+		next := NextRun(u, scheduled)
+		if next.After(now) {
+			return scheduled
 		}
+		scheduled = next
+	}
+}
 
-		// Pause backing up for one minute
-		time.Sleep(60 * time.Second)
+// reschedule moves the user's next run on from now, so several missed runs
+// only lead to one backup. It only succeeds if the next run hasn't been
+// changed since the user was read, so a backup is never started twice for
+// the same run.
+func reschedule(ctx context.Context, userCollection *mongo.Collection, u *user.User, now time.Time) (bool, error) {
+	filter := bson.D{{Key: "username", Value: u.Username}}
+	if u.NextRun.IsZero() {
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "nextrun", Value: u.NextRun}},
+			bson.D{{Key: "nextrun", Value: bson.D{{Key: "$exists", Value: false}}}},
+		}})
+	} else {
+		filter = append(filter, bson.E{Key: "nextrun", Value: u.NextRun})
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "nextrun", Value: NextRun(u, now)},
+		}},
 	}
 
+	res, err := userCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
 }
 
-// BackupUserData backs up the user's data
-func BackupUserData(ctx context.Context, dbc *mongo.Client, user *user.User) {
+// ErrNothingToBackUp is returned for a backup of a user who hasn't picked
+// anything to back up or connected anywhere to put it
+var ErrNothingToBackUp = errors.New("scheduler: nothing to back up or nowhere to put it")
+
+// hasBackups reports whether the user has anything to back up and somewhere to put it
+func hasBackups(u *user.User) bool {
+	return len(backupClouds(u)) > 0 && len(u.Toodledo.ToBackup) > 0
+}
+
+// HandleJob returns the job handler that backs up the job's user
+func HandleJob(dbc *mongo.Client) jobs.Handler {
+	return func(ctx context.Context, job *jobs.Job) error {
+		userCollection, err := db.GetCollection(dbc, "ToodleBackup", "Users")
+		if err != nil {
+			return err
+		}
+
+		// Read the user again, their settings may have changed while queued
+		var u user.User
+		err = userCollection.FindOne(ctx, bson.D{{Key: "username", Value: job.Username}}).Decode(&u)
+		if err != nil {
+			return err
+		}
+		if !hasBackups(&u) {
+			return ErrNothingToBackUp
+		}
+
+		return BackupUserData(ctx, dbc, &u, job.Trigger, jobReporter(ctx, dbc, job))
+	}
+}
+
+// BackupUserData backs up the user's data and records the run in the backup
+// history, telling report what it is doing along the way if it isn't nil
+func BackupUserData(ctx context.Context, dbc *mongo.Client, user *user.User, trigger history.Trigger, report Reporter) error {
 	log.Printf("Backing up the user:  %s\n", user.Username)
 
-	// First refresh toodledo access token
-	toodleInfo, err := toodledo.GetToodledoTokens(user.Toodledo.Refresh, "refresh_token")
-	// Update the user's toodleinfo in mongodb
+	run, err := history.Start(ctx, dbc, user.Username, trigger)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error recording backup run for %s: %v\n", user.Username, err)
 	}
 
-	userCollection, err := db.GetCollection(dbc, "ToodleBackup", "Users")
+	backupErr := backup(ctx, dbc, user, run, report)
+	if backupErr != nil {
+		run.Error = backupErr.Error()
+		log.Printf("Error backing up %s: %v\n", user.Username, backupErr)
+	}
 
+	// Record the run even if the backup was cancelled
+	err = run.Finish(context.Background(), dbc)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error recording backup run for %s: %v\n", user.Username, err)
 	}
 
-	filter := bson.D{{Key: "username", Value: user.Username}}
+	// Let the user know about failures that need them to fix something
+	if userErr := permanentError(backupErr); userErr != user.BackupError {
+		err = setBackupError(dbc, user.Username, userErr)
+		if err != nil {
+			log.Printf("Error recording backup error for %s: %v\n", user.Username, err)
+		}
+	}
+	return backupErr
+}
+
+// permanentError returns the message for an error that retrying won't fix,
+// or an empty string if err is nil, may go away by itself or there was
+// nothing to back up
+func permanentError(err error) string {
+	if err == nil || retry.IsTransient(err) || errors.Is(err, context.Canceled) || errors.Is(err, ErrNothingToBackUp) {
+		return ""
+	}
+	return err.Error()
+}
+
+// setBackupError records why the user's backups are failing, or clears it
+// when msg is empty
+func setBackupError(dbc *mongo.Client, username string, msg string) error {
+	userCollection, err := db.GetCollection(dbc, "ToodleBackup", "Users")
+	if err != nil {
+		return err
+	}
+
+	filter := bson.D{{Key: "username", Value: username}}
 	update := bson.D{
 		{Key: "$set", Value: bson.D{
-			{Key: "toodledo", Value: *toodleInfo},
+			{Key: "backuperror", Value: msg},
 		}},
 	}
+	_, err = userCollection.UpdateOne(context.Background(), filter, update)
+	return err
+}
 
-	_, err = userCollection.UpdateOne(ctx, filter, update)
-
+// backup fetches the user's data from toodledo and uploads it to their clouds,
+// filling in the run's results as it goes
+func backup(ctx context.Context, dbc *mongo.Client, user *user.User, run *history.Run, report Reporter) error {
+	userCollection, err := db.GetCollection(dbc, "ToodleBackup", "Users")
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	filter := bson.D{{Key: "username", Value: user.Username}}
+
+	clouds := backupClouds(user)
+	if len(clouds) == 0 {
+		return ErrNothingToBackUp
 	}
 
-	// Open a file with the current time as the name
-	backupPath := user.Username + " " + time.Now().UTC().String()[:19] + ".xml"
-	f, err := os.Create(backupPath)
+	// Name the backup with the current time, it is written to a temporary file
+	// until it has been uploaded
+	started := time.Now().UTC()
+	f, err := createTempFile()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 
-	now := time.Now().Unix()
-	var offset int64 = 0
-	n, err := f.WriteString(fmt.Sprintf("<xml>\n<title>Toodledo :: XML Backup</title>\n<link>http://www.toodledo.com/</link>\n<toodledoversion>20</toodledoversion>\n<description>Your Toodledo backup</description>\n<export_date>%v</export_date>\n", now))
+	edits, err := writeBackup(ctx, userCollection, user, run, f, report)
+	if err != nil {
+		return err
+	}
+	if run.Kind == history.KindSkipped {
+		log.Printf("Nothing has changed for %s since their last backup\n", user.Username)
+		return nil
+	}
+
+	backupPath := user.Username + " " + started.String()[:19] + ".xml"
+	if run.Kind == history.KindDelta {
+		backupPath = user.Username + " " + started.String()[:19] + retention.DeltaSuffix
+	}
+
+	fi, err := f.Stat()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	offset += int64(n)
-	for _, s := range user.Toodledo.ToBackup {
-		if s != "basic" {
-			endpoint := "/3/" + s + "/get.php"
-			data := append(retrieveFromToodledo(endpoint, toodleInfo.Token)[38:], []byte("\n")...) // Slice to skip <xml version> tag at beginning
-			n, err := f.WriteAt(data, offset)
+	run.Bytes = fi.Size()
+
+	// Upload the backup to every cloud the user has connected
+	uploaded := 0
+	var uploadErr error
+	for i := range clouds {
+		cloud := &clouds[i]
+		token := cloud.Token
+		result := history.DestinationResult{Cloud: cloud.Name}
+		err = retry.Do(ctx, retry.Default, func() error {
+			var err error
+			result.Pruned, err = uploadBackup(ctx, user, cloud, f, backupPath, fi.Size(), report)
+			return err
+		})
+		if err != nil {
+			uploadErr = err
+			result.Error = err.Error()
+			log.Printf("Error uploading backup for %s to %s: %v\n", user.Username, cloud.Name, err)
+		} else {
+			uploaded++
+		}
+		run.Destinations = append(run.Destinations, result)
+
+		if i >= len(user.Clouds) {
+			continue
+		}
+
+		// Some providers rotate refresh tokens when they are used, and the
+		// user needs to know about clouds that won't work until they step in
+		fields := bson.D{}
+		if cloud.Token != token {
+			fields = append(fields, bson.E{Key: fmt.Sprintf("clouds.%d.token", i), Value: cloud.Token})
+		}
+		if cloudErr := permanentError(err); cloudErr != cloud.Error {
+			fields = append(fields, bson.E{Key: fmt.Sprintf("clouds.%d.error", i), Value: cloudErr})
+		}
+		if len(fields) > 0 {
+			_, err = userCollection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: fields}})
 			if err != nil {
-				log.Fatal(err)
+				log.Printf("Error saving %s settings for %s: %v\n", cloud.Name, user.Username, err)
 			}
-			offset += int64(n)
 		}
 	}
-	_, err = f.WriteAt([]byte("</xml>"), offset)
-	if err != nil {
-		log.Fatal(err)
+
+	if uploaded == 0 {
+		return fmt.Errorf("backup could not be uploaded to any cloud: %w", uploadErr)
 	}
 
-	// Use the dropbox refresh token to retrieve an access token
-	var dbxToken string
-	for _, v := range user.Clouds {
-		if v.Name == "Dropbox" {
-			dbxToken = v.Token
+	// Only move on to deltas from this backup once every cloud has it, so a
+	// cloud that missed it gets its changes in the next one
+	fields := bson.D{{Key: "lastsuccess", Value: time.Now().UTC()}}
+	if uploaded == len(clouds) {
+		fields = append(fields, bson.E{Key: "lastedits", Value: edits})
+		if run.Kind == history.KindFull {
+			fields = append(fields, bson.E{Key: "lastfull", Value: started})
 		}
 	}
-	if len(dbxToken) != 0 {
-		accessToken, _, err := dropbox.GetDropboxTokens(dbxToken, "refresh_token")
+	_, err = userCollection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: fields}})
+	return err
+}
+
+// TempDir is where backups are written before being uploaded
+func TempDir() string {
+	return filepath.Join(os.TempDir(), "toodlebackup")
+}
+
+func createTempFile() (*os.File, error) {
+	err := os.MkdirAll(TempDir(), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(TempDir(), "backup-*.xml")
+}
+
+// CleanTempFiles removes backups left behind by an instance that was killed
+// mid-backup. Only files older than a day are removed, in case another
+// instance on the same machine is still using its own.
+func CleanTempFiles() error {
+	entries, err := os.ReadDir(TempDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < 24*time.Hour {
+			continue
+		}
+		err = os.Remove(filepath.Join(TempDir(), entry.Name()))
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Error removing old backup file %s: %v\n", entry.Name(), err)
 		}
+	}
+	return nil
+}
 
-		// Call the dropbox python script with the backupPath and the access token
-		cmd := exec.Command("python", "./backup.py", backupPath, accessToken)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
-		if err != nil {
-			log.Fatal(err)
+// writeBackup writes the user's data from toodledo to f, waiting its turn so
+// only so many backups use the toodledo api at once. Only what has changed
+// since the previous backup is written if a full backup isn't due, and
+// nothing at all if nothing has changed. It returns toodledo's last edit
+// times from before the data was fetched.
+func writeBackup(ctx context.Context, userCollection *mongo.Collection, user *user.User, run *history.Run, f *os.File, report Reporter) (user.ToodleEdits, error) {
+	release, err := limits.Default.Acquire(ctx, limits.Toodledo)
+	if err != nil {
+		return user.LastEdits, err
+	}
+	defer release()
+
+	// First refresh toodledo access token
+	toodleInfo, err := refreshToodledo(ctx, user.Toodledo.Refresh)
+	if err != nil {
+		return user.LastEdits, err
+	}
+
+	// Update the user's toodleinfo in mongodb
+	filter := bson.D{{Key: "username", Value: user.Username}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "toodledo", Value: *toodleInfo},
+		}},
+	}
+
+	_, err = userCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return user.LastEdits, err
+	}
+
+	client := toodledo.NewClient(toodleInfo.Token)
+	account, err := client.Account(ctx)
+	if err != nil {
+		return user.LastEdits, err
+	}
+	edits := accountEdits(account)
+
+	ch := &changes{prev: user.LastEdits, cur: edits, full: true}
+	run.Kind = history.KindFull
+	if incremental(user) {
+		if edits == user.LastEdits && tracksAll(user.Toodledo.ToBackup) {
+			run.Kind = history.KindSkipped
+			return edits, nil
 		}
+		ch.full = false
+		run.Kind = history.KindDelta
+	}
+
+	enc := xml.NewEncoder(f)
+	enc.Indent("", "  ")
+	root, err := startBackupFile(enc, run.Kind, time.Now())
+	if err != nil {
+		return edits, err
+	}
 
+	for i, s := range user.Toodledo.ToBackup {
+		fetch, ok := sections[s]
+		if !ok {
+			continue
+		}
+		report.report(jobs.StageFetching, s, i*100/len(user.Toodledo.ToBackup))
+
+		err = writeSection(ctx, enc, client, ch, run, s, fetch)
+		if err != nil {
+			return edits, err
+		}
+		if fetchDeleted, ok := deletions[s]; ok {
+			err = writeSection(ctx, enc, client, ch, run, "deleted"+s, fetchDeleted)
+			if err != nil {
+				return edits, err
+			}
+		}
 	}
 
-	err = os.Remove(backupPath)
+	err = enc.EncodeToken(root.End())
 	if err != nil {
-		log.Fatal(err)
+		return edits, err
 	}
+	return edits, enc.Flush()
+}
 
+// incremental reports whether the user's next backup can be a delta, which it
+// can once they have a full backup that isn't too old
+func incremental(u *user.User) bool {
+	interval := FullBackupInterval()
+	return interval > 0 && !u.LastFull.IsZero() && time.Since(u.LastFull) < interval &&
+		u.LastEdits != (user.ToodleEdits{})
 }
 
-func retrieveFromToodledo(endpoint string, token string) []byte {
+// writeSection fetches a section and writes it to the backup file under name,
+// counting its items and recording any deletions in the run
+func writeSection(ctx context.Context, enc *xml.Encoder, client *toodledo.Client, ch *changes, run *history.Run, name string, fetch fetchFunc) error {
+	sec, err := fetch(ctx, client, ch)
+	if err != nil || sec == nil {
+		return err
+	}
 
-	client := &http.Client{}
+	run.Counts[name] = sec.count
+	run.AddDeletions(sec.deletions)
+	if sec.Total > 0 {
+		run.Totals[name] = sec.Total
+		if sec.count < sec.Total {
+			log.Printf("Backup for %s has %d of %d %s\n", run.Username, sec.count, sec.Total, name)
+		}
+	}
 
-	apiURL := "https://api.toodledo.com"
-	u, _ := url.ParseRequestURI(apiURL)
-	u.Path = endpoint
-	urlStr := u.String()
+	sec.XMLName = xml.Name{Local: name}
+	return enc.Encode(sec)
+}
 
-	req, _ := http.NewRequest(http.MethodGet, urlStr, nil)
-	params := req.URL.Query()
-	if endpoint == "/3/tasks/get.php" {
-		params.Add("fields", taskFields)
+// refreshToodledo gets a new toodledo access token, retrying while toodledo is
+// unavailable and waiting out its limit on token requests like any other
+func refreshToodledo(ctx context.Context, refresh string) (*user.ToodleInfo, error) {
+	var info *user.ToodleInfo
+	err := toodledo.DefaultThrottle.Do(ctx, refresh, retry.Default, func() error {
+		var err error
+		info, err = toodledo.GetToodledoTokens(refresh, "refresh_token")
+		return err
+	})
+	return info, err
+}
+
+// backupClouds returns the user's clouds, plus the server's backup directory
+// when one is configured
+func backupClouds(u *user.User) []user.Cloud {
+	if !localfs.Enabled() {
+		return u.Clouds
+	}
+
+	for _, c := range u.Clouds {
+		if c.Name == localfs.Name {
+			return u.Clouds
+		}
 	}
-	params.Add("access_token", token)
-	params.Add("f", "xml")
-	req.URL.RawQuery = params.Encode()
 
-	resp, err := client.Do(req)
+	clouds := make([]user.Cloud, len(u.Clouds), len(u.Clouds)+1)
+	copy(clouds, u.Clouds)
+	return append(clouds, user.Cloud{Name: localfs.Name})
+}
+
+// uploadBackup uploads the backup file to the destination for a single cloud,
+// returning how many old backups were pruned afterwards
+func uploadBackup(ctx context.Context, u *user.User, cloud *user.Cloud, f *os.File, name string, size int64, report Reporter) (int, error) {
+	report.report(jobs.StageUploading, cloud.Name, 0)
+	release, err := limits.Default.Acquire(ctx, cloud.Name)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
+	defer release()
 
-	defer resp.Body.Close()
+	dest, err := storage.Open(ctx, u, cloud)
+	if err != nil {
+		return 0, err
+	}
+	// Some destinations hold a connection open
+	if closer, ok := dest.(io.Closer); ok {
+		defer closer.Close()
+	}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+	_, err = f.Seek(0, io.SeekStart)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 
-	return bytes
+	r := &progressReader{r: f, size: size, onRead: func(percent int) {
+		report.report(jobs.StageUploading, cloud.Name, percent)
+	}}
+	err = dest.Upload(ctx, name, r, size)
+	if err != nil {
+		return 0, err
+	}
 
+	// Only prune old backups once the new one is safely stored
+	policy := &u.Retention
+	if cloud.Retention != nil {
+		policy = cloud.Retention
+	}
+	deleted, err := retention.Apply(ctx, dest, u.Username+" ", policy, time.Now())
+	if len(deleted) > 0 {
+		log.Printf("Removed %d old backups for %s from %s\n", len(deleted), u.Username, cloud.Name)
+	}
+	if err != nil {
+		log.Printf("Error applying retention for %s to %s: %v\n", u.Username, cloud.Name, err)
+	}
+	return len(deleted), nil
 }
@@ -0,0 +1,152 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+func init() {
+	storage.Register(Name, open)
+}
+
+// destination stores backups in a directory on an sftp server, it holds an
+// open connection so must be closed once finished with
+type destination struct {
+	conn *connection
+	dir  string
+}
+
+func open(ctx context.Context, _ *user.User, c *user.Cloud) (storage.Destination, error) {
+	cfg := configFromCloud(c)
+	conn, err := dial(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := cfg.Directory
+	if dir == "" {
+		dir = "."
+	}
+	return &destination{conn: conn, dir: dir}, nil
+}
+
+func (d *destination) Close() error {
+	return d.conn.Close()
+}
+
+// Upload writes to a temporary file first so a failed upload never
+// replaces a good backup with a partial one
+func (d *destination) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	stop := d.conn.watch(ctx)
+	err := d.upload(name, r)
+	stop()
+	return ctxErr(ctx, err)
+}
+
+func (d *destination) upload(name string, r io.Reader) error {
+	client := d.conn.client
+	err := client.MkdirAll(d.dir)
+	if err != nil {
+		return err
+	}
+
+	final := path.Join(d.dir, name)
+	tmp := final + ".part"
+
+	f, err := client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return err
+	}
+
+	err = client.PosixRename(tmp, final)
+	if err != nil {
+		// Servers without the posix-rename extension won't overwrite
+		client.Remove(final)
+		err = client.Rename(tmp, final)
+	}
+	return err
+}
+
+func (d *destination) List(ctx context.Context) ([]storage.FileInfo, error) {
+	stop := d.conn.watch(ctx)
+	entries, err := d.conn.client.ReadDir(d.dir)
+	stop()
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	files := make([]storage.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.Mode().IsRegular() {
+			files = append(files, toFileInfo(e))
+		}
+	}
+	return files, nil
+}
+
+func (d *destination) Delete(ctx context.Context, name string) error {
+	stop := d.conn.watch(ctx)
+	err := d.conn.client.Remove(path.Join(d.dir, name))
+	stop()
+	if os.IsNotExist(err) {
+		return storage.ErrNotFound
+	}
+	return ctxErr(ctx, err)
+}
+
+func (d *destination) Stat(ctx context.Context, name string) (*storage.FileInfo, error) {
+	stop := d.conn.watch(ctx)
+	fi, err := d.conn.client.Stat(path.Join(d.dir, name))
+	stop()
+	if os.IsNotExist(err) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	info := toFileInfo(fi)
+	return &info, nil
+}
+
+// Quota relies on the statvfs@openssh.com extension, which not every server has
+func (d *destination) Quota(ctx context.Context) (*storage.Quota, error) {
+	stop := d.conn.watch(ctx)
+	vfs, err := d.conn.client.StatVFS(d.dir)
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", storage.ErrQuotaUnavailable, err)
+	}
+
+	total := int64(vfs.TotalSpace())
+	return &storage.Quota{Used: total - int64(vfs.FreeSpace()), Total: total}, nil
+}
+
+// ctxErr returns ctx's error in place of err when the connection was closed
+// because ctx was done
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func toFileInfo(fi os.FileInfo) storage.FileInfo {
+	return storage.FileInfo{Name: fi.Name(), Size: fi.Size(), Modified: fi.ModTime()}
+}
@@ -0,0 +1,221 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	sftpclient "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// serve runs an ssh server on a local port that answers the sftp subsystem
+// with handlers, letting alice in with the password secret
+func serve(t *testing.T, handlers sftpclient.Handlers) (*Config, ssh.PublicKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() != "alice" || string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config, handlers)
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return &Config{Host: "127.0.0.1", Port: addr.Port, Username: "alice", Password: "secret"}, hostKey.PublicKey()
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig, handlers sftpclient.Handlers) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				// The payload is the subsystem name as an ssh string
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server := sftpclient.NewRequestServer(channel, handlers)
+					go func() {
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func TestDestination(t *testing.T) {
+	cfg, hostKey := serve(t, sftpclient.InMemHandler())
+	cfg.Directory = "/backups/toodledo"
+
+	ctx := context.Background()
+	cloud, err := Connect(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cloud.Config["fingerprint"] != ssh.FingerprintSHA256(hostKey) {
+		t.Errorf("pinned fingerprint %s, want the server's %s", cloud.Config["fingerprint"], ssh.FingerprintSHA256(hostKey))
+	}
+
+	dest, err := storage.Open(ctx, &user.User{}, cloud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.(io.Closer).Close()
+
+	err = dest.Upload(ctx, "a.xml", strings.NewReader("first"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.Upload(ctx, "b.xml", strings.NewReader("second"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Uploading an existing name replaces it
+	err = dest.Upload(ctx, "a.xml", strings.NewReader("replaced"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.(*destination).conn.client.Mkdir("/backups/toodledo/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := dest.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	if len(files) != 2 || files[0].Name != "a.xml" || files[0].Size != 8 || files[1].Name != "b.xml" {
+		t.Errorf("List() = %+v, want the two backups but not the directory or any partial uploads", files)
+	}
+
+	err = dest.Delete(ctx, "a.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.Delete(ctx, "a.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("deleting a missing file returned %v, want storage.ErrNotFound", err)
+	}
+	_, err = dest.Stat(ctx, "a.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("Stat() of a deleted file returned %v, want storage.ErrNotFound", err)
+	}
+
+	_, err = dest.Quota(ctx)
+	if !errors.Is(err, storage.ErrQuotaUnavailable) {
+		t.Errorf("Quota() without statvfs returned %v, want storage.ErrQuotaUnavailable", err)
+	}
+}
+
+func TestHostKeyMismatch(t *testing.T) {
+	cfg, _ := serve(t, sftpclient.InMemHandler())
+	cfg.Fingerprint = "SHA256:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+
+	_, err := Connect(context.Background(), cfg)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("Connect() to a server with another key returned %v, want ErrHostKeyMismatch", err)
+	}
+}
+
+// stalledWriter accepts files but never finishes writing them until released
+type stalledWriter chan struct{}
+
+func (s stalledWriter) Filewrite(*sftpclient.Request) (io.WriterAt, error) {
+	return s, nil
+}
+
+func (s stalledWriter) WriteAt(p []byte, _ int64) (int, error) {
+	<-s
+	return len(p), nil
+}
+
+func TestUploadStalled(t *testing.T) {
+	stalled := make(stalledWriter)
+	defer close(stalled)
+
+	handlers := sftpclient.InMemHandler()
+	handlers.FilePut = stalled
+	cfg, _ := serve(t, handlers)
+	cfg.Directory = "/backups"
+
+	ctx := context.Background()
+	cloud, err := Connect(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := storage.Open(ctx, &user.User{}, cloud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.(io.Closer).Close()
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- dest.Upload(ctx, "a.xml", strings.NewReader("first"), 5) }()
+
+	select {
+	case err = <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Upload() to a stalled server returned %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload() to a stalled server didn't give up when its context expired")
+	}
+}
@@ -0,0 +1,257 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	sftpclient "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// Name is the cloud name sftp destinations are registered under
+const Name = "SFTP"
+
+const (
+	defaultPort = 22
+	dialTimeout = 30 * time.Second
+
+	// keepAliveInterval is how often the server is checked on, and how long
+	// it has to answer before the connection is given up on
+	keepAliveInterval = 30 * time.Second
+)
+
+// ErrHostKeyMismatch is returned when the server's host key doesn't match the pinned fingerprint
+var ErrHostKeyMismatch = errors.New("sftp: host key does not match pinned fingerprint")
+
+// Config describes how to reach a user's sftp server. Either Password or
+// PrivateKey must be set. Fingerprint is the SHA256 host key fingerprint as
+// printed by ssh-keygen -l, when empty the key seen on connect is pinned.
+type Config struct {
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PrivateKey  string `json:"privateKey"`
+	Fingerprint string `json:"fingerprint"`
+	Directory   string `json:"directory"`
+}
+
+// Connect logs in to the server, creates the backup directory, and returns
+// the cloud to store for the user with the password or private key as its token
+func Connect(ctx context.Context, cfg *Config) (*user.Cloud, error) {
+	if cfg.Host == "" || cfg.Username == "" {
+		return nil, errors.New("sftp: host and username are required")
+	}
+	if (cfg.Password == "") == (cfg.PrivateKey == "") {
+		return nil, errors.New("sftp: exactly one of password and private key is required")
+	}
+
+	if cfg.Port == 0 {
+		cfg.Port = defaultPort
+	}
+
+	conn, err := dial(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if cfg.Directory != "" {
+		stop := conn.watch(ctx)
+		err = conn.client.MkdirAll(cfg.Directory)
+		stop()
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+	}
+
+	auth, token := "password", cfg.Password
+	if cfg.PrivateKey != "" {
+		auth, token = "key", cfg.PrivateKey
+	}
+
+	return &user.Cloud{
+		Name:  Name,
+		Token: token,
+		Config: map[string]string{
+			"host":        cfg.Host,
+			"port":        strconv.Itoa(cfg.Port),
+			"username":    cfg.Username,
+			"auth":        auth,
+			"fingerprint": conn.fingerprint,
+			"directory":   cfg.Directory,
+		},
+	}, nil
+}
+
+// configFromCloud rebuilds the connection settings stored by Connect
+func configFromCloud(c *user.Cloud) *Config {
+	port, _ := strconv.Atoi(c.Config["port"])
+	cfg := &Config{
+		Host:        c.Config["host"],
+		Port:        port,
+		Username:    c.Config["username"],
+		Fingerprint: c.Config["fingerprint"],
+		Directory:   c.Config["directory"],
+	}
+	if c.Config["auth"] == "key" {
+		cfg.PrivateKey = c.Token
+	} else {
+		cfg.Password = c.Token
+	}
+	return cfg
+}
+
+// connection is an sftp session along with the ssh connection it runs over
+type connection struct {
+	ssh         *ssh.Client
+	client      *sftpclient.Client
+	fingerprint string
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// Close tears down the ssh connection first, closing the sftp session on its
+// own waits for the server to hang up which not every server does
+func (c *connection) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	err := c.ssh.Close()
+	c.client.Close()
+	return err
+}
+
+// watch closes the connection if ctx is done before the returned function is
+// called, so an operation on a stalled server gives up with ctx
+func (c *connection) watch(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.ssh.Close()
+		case <-done:
+		case <-c.closed:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// keepAlive closes the connection if the server stops answering, until the
+// connection is closed
+func (c *connection) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			// Servers that don't know the request still answer it
+			_, _, err := c.ssh.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+		case <-time.After(keepAliveInterval):
+			c.ssh.Close()
+			return
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func dial(ctx context.Context, cfg *Config) (*connection, error) {
+	var auth ssh.AuthMethod
+	if cfg.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(cfg.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		auth = ssh.PublicKeys(signer)
+	} else {
+		auth = ssh.Password(cfg.Password)
+	}
+
+	conn := &connection{closed: make(chan struct{})}
+	var hostKeyErr error
+	sshConfig := &ssh.ClientConfig{
+		User: cfg.Username,
+		Auth: []ssh.AuthMethod{auth},
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			conn.fingerprint = ssh.FingerprintSHA256(key)
+			if cfg.Fingerprint != "" && cfg.Fingerprint != conn.fingerprint {
+				hostKeyErr = fmt.Errorf("%w: got %s", ErrHostKeyMismatch, conn.fingerprint)
+			}
+			return hostKeyErr
+		},
+		Timeout: dialTimeout,
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+
+	d := net.Dialer{Timeout: dialTimeout}
+	netConn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// sshConfig.Timeout only covers ssh.Dial, so stop a server that accepts the
+	// connection and then stalls from hanging the handshake
+	deadline := time.Now().Add(dialTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err = netConn.SetDeadline(deadline)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, sshConfig)
+	if err != nil {
+		netConn.Close()
+		// The handshake error only keeps the text of ours, so hand it back
+		// as is for errors.Is
+		if hostKeyErr != nil {
+			return nil, hostKeyErr
+		}
+		return nil, err
+	}
+	conn.ssh = ssh.NewClient(sshConn, chans, reqs)
+
+	conn.client, err = sftpclient.NewClient(conn.ssh)
+	if err != nil {
+		conn.ssh.Close()
+		return nil, err
+	}
+
+	// Uploads can take much longer than the handshake, so from here on a
+	// stalled server is caught by keepAlive and each operation's ctx instead
+	err = netConn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go conn.keepAlive()
+	return conn, nil
+}
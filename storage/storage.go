@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+var (
+	// ErrNotFound is returned when a file does not exist at the destination
+	ErrNotFound = errors.New("storage: file not found")
+	// ErrQuotaUnavailable is returned by destinations that cannot report usage
+	ErrQuotaUnavailable = errors.New("storage: quota unavailable")
+)
+
+// FileInfo describes a backup file stored at a destination
+type FileInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Quota describes the space used at a destination in bytes, Total is 0 when unlimited
+type Quota struct {
+	Used  int64 `json:"used"`
+	Total int64 `json:"total"`
+}
+
+// Destination is somewhere a user's backup files can be kept
+type Destination interface {
+	// Upload writes size bytes from r to name, replacing any existing file
+	Upload(ctx context.Context, name string, r io.Reader, size int64) error
+	// List returns the backup files at the destination
+	List(ctx context.Context) ([]FileInfo, error)
+	// Delete removes the file called name
+	Delete(ctx context.Context, name string) error
+	// Stat returns info about the file called name, or ErrNotFound
+	Stat(ctx context.Context, name string) (*FileInfo, error)
+	// Quota returns the space used at the destination
+	Quota(ctx context.Context) (*Quota, error)
+}
+
+// Opener connects to the destination described by a user's cloud
+type Opener func(ctx context.Context, u *user.User, c *user.Cloud) (Destination, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = make(map[string]Opener)
+)
+
+// Register makes a destination available under the given cloud name,
+// it is meant to be called from the init function of each provider
+func Register(name string, open Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+
+	if open == nil {
+		panic("storage: Register opener is nil")
+	}
+	if _, dup := openers[name]; dup {
+		panic("storage: Register called twice for " + name)
+	}
+	openers[name] = open
+}
+
+// Open connects to the destination registered under the cloud's name
+func Open(ctx context.Context, u *user.User, c *user.Cloud) (Destination, error) {
+	openersMu.RLock()
+	open, ok := openers[c.Name]
+	openersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown cloud %q", c.Name)
+	}
+	return open(ctx, u, c)
+}
@@ -0,0 +1,372 @@
+package toodledo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jarota/ToodleBackupBackend/retry"
+)
+
+// DefaultBaseURL is where clients send requests unless told otherwise
+var DefaultBaseURL = "https://api.toodledo.com/3"
+
+// MaxTasks and MaxNotes are the most tasks or notes toodledo sends in one request
+const (
+	MaxTasks = 1000
+	MaxNotes = 1000
+)
+
+// Client makes requests to the toodledo api on behalf of a user. Requests
+// that fail while toodledo is unavailable are retried according to Retry, and
+// are spaced out by Throttle when it isn't nil.
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+	Retry      retry.Policy
+	Throttle   *Throttle
+}
+
+// NewClient creates a client for the user with the given access token
+func NewClient(token string) *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		Token:      token,
+		HTTPClient: http.DefaultClient,
+		Retry:      retry.Default,
+		Throttle:   DefaultThrottle,
+	}
+}
+
+// Completion picks tasks by whether they have been completed
+type Completion int
+
+// Completions to ask toodledo for
+const (
+	AllTasks Completion = iota
+	IncompleteTasks
+	CompletedTasks
+)
+
+// TaskQuery picks which tasks to fetch. Fields lists the optional fields to
+// include, ModAfter only includes tasks modified after that unix time, and
+// Start and Num pick a page of the results.
+type TaskQuery struct {
+	Fields     []string
+	Completion Completion
+	ModAfter   int64
+	Start      int
+	Num        int
+}
+
+// TaskPage is a page of tasks. Total is how many tasks matched altogether.
+type TaskPage struct {
+	Num   int
+	Total int
+	Tasks []Task
+}
+
+// NoteQuery picks which notes to fetch, like TaskQuery
+type NoteQuery struct {
+	ModAfter int64
+	Start    int
+	Num      int
+}
+
+// NotePage is a page of notes. Total is how many notes matched altogether.
+type NotePage struct {
+	Num   int
+	Total int
+	Notes []Note
+}
+
+// header is sent before the items in some lists, Total only when the list
+// can be paged through
+type header struct {
+	Num   Int `json:"num"`
+	Total Int `json:"total"`
+}
+
+// Account returns the user's account details
+func (c *Client) Account(ctx context.Context) (*Account, error) {
+	var account Account
+	err := c.get(ctx, "/account/get.php", nil, &account)
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Tasks returns a page of the user's tasks
+func (c *Client) Tasks(ctx context.Context, q TaskQuery) (*TaskPage, error) {
+	params := url.Values{}
+	if len(q.Fields) > 0 {
+		params.Set("fields", strings.Join(q.Fields, ","))
+	}
+	switch q.Completion {
+	case IncompleteTasks:
+		params.Set("comp", "0")
+	case CompletedTasks:
+		params.Set("comp", "1")
+	}
+	setPage(params, q.ModAfter, q.Start, q.Num)
+
+	var page TaskPage
+	h, err := c.getList(ctx, "/tasks/get.php", params, &page.Tasks)
+	if err != nil {
+		return nil, err
+	}
+	page.Num, page.Total = int(h.Num), int(h.Total)
+	return &page, nil
+}
+
+// FetchAllTasks returns every task matching q, fetching MaxTasks at a time
+// until toodledo's total is reached. q.Start and q.Num are ignored, and Total
+// is the total toodledo last reported.
+func (c *Client) FetchAllTasks(ctx context.Context, q TaskQuery) (*TaskPage, error) {
+	all := &TaskPage{}
+	q.Start, q.Num = 0, MaxTasks
+	for {
+		page, err := c.Tasks(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		all.Tasks = append(all.Tasks, page.Tasks...)
+		all.Total = page.Total
+
+		// Stop on an empty page too, in case tasks were deleted while paging
+		q.Start += len(page.Tasks)
+		if len(page.Tasks) == 0 || q.Start >= page.Total {
+			break
+		}
+	}
+	all.Num = len(all.Tasks)
+	return all, nil
+}
+
+// Notes returns a page of the user's notes
+func (c *Client) Notes(ctx context.Context, q NoteQuery) (*NotePage, error) {
+	params := url.Values{}
+	setPage(params, q.ModAfter, q.Start, q.Num)
+
+	var page NotePage
+	h, err := c.getList(ctx, "/notes/get.php", params, &page.Notes)
+	if err != nil {
+		return nil, err
+	}
+	page.Num, page.Total = int(h.Num), int(h.Total)
+	return &page, nil
+}
+
+// FetchAllNotes returns every note matching q, fetching MaxNotes at a time
+// like FetchAllTasks
+func (c *Client) FetchAllNotes(ctx context.Context, q NoteQuery) (*NotePage, error) {
+	all := &NotePage{}
+	q.Start, q.Num = 0, MaxNotes
+	for {
+		page, err := c.Notes(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		all.Notes = append(all.Notes, page.Notes...)
+		all.Total = page.Total
+
+		q.Start += len(page.Notes)
+		if len(page.Notes) == 0 || q.Start >= page.Total {
+			break
+		}
+	}
+	all.Num = len(all.Notes)
+	return all, nil
+}
+
+// DeletedTasks returns the tasks deleted after the given unix time
+func (c *Client) DeletedTasks(ctx context.Context, after int64) ([]Deletion, error) {
+	var deleted []Deletion
+	params := url.Values{}
+	setPage(params, after, 0, 0)
+	_, err := c.getList(ctx, "/tasks/deleted.php", params, &deleted)
+	return deleted, err
+}
+
+// DeletedNotes returns the notes deleted after the given unix time
+func (c *Client) DeletedNotes(ctx context.Context, after int64) ([]Deletion, error) {
+	var deleted []Deletion
+	params := url.Values{}
+	setPage(params, after, 0, 0)
+	_, err := c.getList(ctx, "/notes/deleted.php", params, &deleted)
+	return deleted, err
+}
+
+// Folders returns the user's folders
+func (c *Client) Folders(ctx context.Context) ([]Folder, error) {
+	var folders []Folder
+	_, err := c.getList(ctx, "/folders/get.php", nil, &folders)
+	return folders, err
+}
+
+// Contexts returns the user's contexts
+func (c *Client) Contexts(ctx context.Context) ([]Context, error) {
+	var contexts []Context
+	_, err := c.getList(ctx, "/contexts/get.php", nil, &contexts)
+	return contexts, err
+}
+
+// Goals returns the user's goals
+func (c *Client) Goals(ctx context.Context) ([]Goal, error) {
+	var goals []Goal
+	_, err := c.getList(ctx, "/goals/get.php", nil, &goals)
+	return goals, err
+}
+
+// Locations returns the user's locations
+func (c *Client) Locations(ctx context.Context) ([]Location, error) {
+	var locations []Location
+	_, err := c.getList(ctx, "/locations/get.php", nil, &locations)
+	return locations, err
+}
+
+// Outlines returns the user's outlines
+func (c *Client) Outlines(ctx context.Context) ([]Outline, error) {
+	var outlines []Outline
+	_, err := c.getList(ctx, "/outlines/get.php", nil, &outlines)
+	return outlines, err
+}
+
+// Lists returns the user's lists
+func (c *Client) Lists(ctx context.Context) ([]List, error) {
+	var lists []List
+	_, err := c.getList(ctx, "/lists/get.php", nil, &lists)
+	return lists, err
+}
+
+// Rows returns the rows of the list with the given id
+func (c *Client) Rows(ctx context.Context, list Int) ([]Row, error) {
+	var rows []Row
+	params := url.Values{}
+	params.Set("list", strconv.FormatInt(int64(list), 10))
+	_, err := c.getList(ctx, "/rows/get.php", params, &rows)
+	return rows, err
+}
+
+// Habits returns the user's habits
+func (c *Client) Habits(ctx context.Context) ([]Habit, error) {
+	var habits []Habit
+	_, err := c.getList(ctx, "/habits/get.php", nil, &habits)
+	return habits, err
+}
+
+func setPage(params url.Values, modAfter int64, start int, num int) {
+	if modAfter > 0 {
+		params.Set("after", strconv.FormatInt(modAfter, 10))
+	}
+	if start > 0 {
+		params.Set("start", strconv.Itoa(start))
+	}
+	if num > 0 {
+		params.Set("num", strconv.Itoa(num))
+	}
+}
+
+// getList decodes a json array from toodledo into items, returning the
+// num/total header toodledo sends first for some lists
+func (c *Client) getList(ctx context.Context, endpoint string, params url.Values, items interface{}) (header, error) {
+	var raw []json.RawMessage
+	err := c.get(ctx, endpoint, params, &raw)
+	if err != nil {
+		return header{}, err
+	}
+
+	var h header
+	if len(raw) > 0 && isHeader(raw[0]) {
+		err = json.Unmarshal(raw[0], &h)
+		if err != nil {
+			return header{}, fmt.Errorf("toodledo: decoding %s: %w", endpoint, err)
+		}
+		raw = raw[1:]
+	} else {
+		h.Num, h.Total = Int(len(raw)), Int(len(raw))
+	}
+
+	list, err := json.Marshal(raw)
+	if err != nil {
+		return header{}, err
+	}
+	err = json.Unmarshal(list, items)
+	if err != nil {
+		return header{}, fmt.Errorf("toodledo: decoding %s: %w", endpoint, err)
+	}
+	return h, nil
+}
+
+// isHeader reports whether an item in a list is really the num/total header
+func isHeader(item json.RawMessage) bool {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(item, &fields) != nil {
+		return false
+	}
+	_, hasNum := fields["num"]
+	_, hasTotal := fields["total"]
+	_, hasID := fields["id"]
+	return (hasNum || hasTotal) && !hasID
+}
+
+// get requests endpoint as json, decoding the response into v. When toodledo
+// says we have made too many requests, the request waits for a while and is
+// tried again rather than counting as a failure, as described by Throttle.Do.
+func (c *Client) get(ctx context.Context, endpoint string, params url.Values, v interface{}) error {
+	op := func() error {
+		return c.request(ctx, endpoint, params, v)
+	}
+	if c.Throttle == nil {
+		return retry.Do(ctx, c.Retry, op)
+	}
+	return c.Throttle.Do(ctx, c.Token, c.Retry, op)
+}
+
+func (c *Client) request(ctx context.Context, endpoint string, params url.Values, v interface{}) error {
+	query := url.Values{}
+	for k, vs := range params {
+		query[k] = vs
+	}
+	query.Set("access_token", c.Token)
+	query.Set("f", "json")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(c.BaseURL, "/")+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	err = ResponseError(resp.StatusCode, body)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(bytes.TrimSpace(body), v)
+	if err != nil {
+		return fmt.Errorf("toodledo: decoding %s: %w", endpoint, err)
+	}
+	return nil
+}
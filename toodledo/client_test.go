@@ -0,0 +1,49 @@
+package toodledo
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestFetchAllNotes(t *testing.T) {
+	const total = 2500
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		num, _ := strconv.Atoi(r.URL.Query().Get("num"))
+		if num > MaxNotes {
+			t.Errorf("asked for %d notes, toodledo only sends %d", num, MaxNotes)
+		}
+
+		list := []interface{}{map[string]int{"num": 0, "total": total}}
+		for i := start; i < start+num && i < total; i++ {
+			list = append(list, map[string]interface{}{"id": i + 1, "title": "note"})
+		}
+		list[0] = map[string]int{"num": len(list) - 1, "total": total}
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer srv.Close()
+
+	c := NewClient("token")
+	c.BaseURL = srv.URL
+	c.Throttle = nil
+
+	page, err := c.FetchAllNotes(context.Background(), NoteQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Num != total || page.Total != total || len(page.Notes) != total {
+		t.Errorf("got %d notes of %d, want all %d", page.Num, page.Total, total)
+	}
+	if page.Notes[total-1].ID != total {
+		t.Errorf("last note has id %d, want %d", page.Notes[total-1].ID, total)
+	}
+	if requests != 3 {
+		t.Errorf("made %d requests, want 3", requests)
+	}
+}
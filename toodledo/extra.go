@@ -0,0 +1,86 @@
+package toodledo
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Extra holds the fields toodledo sent for an item that it has no field for,
+// so that a backup doesn't lose anything toodledo adds later. They are written
+// to XML after the item's other fields, strings as their text and anything
+// else as json. A field whose name can't be an element name, such as "12",
+// is written as <field name="12">.
+type Extra map[string]json.RawMessage
+
+// MarshalXML writes each field as an element of its own, in name order
+func (e Extra) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var text string
+		if json.Unmarshal(e[name], &text) != nil {
+			text = string(e[name])
+		}
+		start := xml.StartElement{Name: xml.Name{Local: name}}
+		if !elementName(name) {
+			start = xml.StartElement{
+				Name: xml.Name{Local: "field"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}},
+			}
+		}
+		err := enc.EncodeElement(text, start)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// elementName reports whether name can be used as an element name as it is.
+// Only ascii names are allowed, which is all toodledo uses.
+func elementName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case i > 0 && (r >= '0' && r <= '9' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// unmarshalExtra decodes data into v, a pointer to a struct, returning the
+// fields in data that v has no json tag for
+func unmarshalExtra(data []byte, v interface{}) (Extra, error) {
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		delete(fields, name)
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
@@ -0,0 +1,58 @@
+package toodledo
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+)
+
+func TestExtraXML(t *testing.T) {
+	var row Row
+	err := json.Unmarshal([]byte(`{"id":"7","added":1,"modified":2,"12":"twelve","cells":{"c1":"a"},"xmlish":"x","note":null}`), &row)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := xml.Marshal(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<row><id>7</id><modified>2</modified><added>1</added><field name="12">twelve</field>` +
+		`<cells>{&#34;c1&#34;:&#34;a&#34;}</cells><note></note><field name="xmlish">x</field></row>`
+	if string(data) != want {
+		t.Errorf("got  %s\nwant %s", data, want)
+	}
+
+	// The backup has to be read back in
+	var parsed struct {
+		Fields []struct {
+			Name  string `xml:"name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"field"`
+	}
+	err = xml.Unmarshal(data, &parsed)
+	if err != nil {
+		t.Fatalf("backup isn't well formed: %v", err)
+	}
+	if len(parsed.Fields) != 2 || parsed.Fields[0].Name != "12" || parsed.Fields[0].Value != "twelve" {
+		t.Errorf("fields read back as %+v", parsed.Fields)
+	}
+}
+
+func TestElementName(t *testing.T) {
+	tests := map[string]bool{
+		"cells":     true,
+		"_private":  true,
+		"last-ed.1": true,
+		"12":        false,
+		"c 1":       false,
+		"":          false,
+		"XMLthing":  false,
+		"-a":        false,
+	}
+	for name, want := range tests {
+		if got := elementName(name); got != want {
+			t.Errorf("elementName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
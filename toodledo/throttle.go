@@ -0,0 +1,145 @@
+package toodledo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/limits"
+	"github.com/jarota/ToodleBackupBackend/retry"
+)
+
+// Requests a minute allowed by DefaultThrottle, toodledo doesn't publish its
+// limits so these are kept well below where it starts turning us away. They
+// are counted by each process, so when several instances of the backend are
+// running the app rate has to be shared out between them.
+const (
+	DefaultAppRate   = 300
+	DefaultTokenRate = 60
+)
+
+// RateLimitPause is how long requests with a token stop for when toodledo
+// says it has made too many, and MaxRateLimitPauses how many times a request
+// waits like this before giving up. Toodledo doesn't say whether it was the
+// token or the whole app that went over, so every request stops for
+// AppRateLimitPause too.
+const (
+	RateLimitPause     = time.Minute
+	AppRateLimitPause  = 10 * time.Second
+	MaxRateLimitPauses = 5
+)
+
+// Throttle spaces out requests to toodledo, so that every client together
+// stays within the limit for the app and each token within its own limit
+type Throttle struct {
+	app       *limits.Rate
+	tokenRate int
+
+	mu        sync.Mutex
+	tokens    map[string]*limits.Rate
+	lastSweep time.Time
+}
+
+// DefaultThrottle is shared by every client unless told otherwise
+var DefaultThrottle = NewThrottle(DefaultAppRate, DefaultTokenRate)
+
+// NewThrottle allows appRate requests a minute across every token, and
+// tokenRate a minute with each one. Either can be bursted through for ten
+// seconds' worth of requests. A rate of 0 or less means unlimited.
+func NewThrottle(appRate int, tokenRate int) *Throttle {
+	return &Throttle{
+		app:       limits.NewRate(appRate, appRate/6),
+		tokenRate: tokenRate,
+		tokens:    map[string]*limits.Rate{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Wait blocks until a request with token is allowed or ctx is cancelled. An
+// empty token only waits for the app's limit, for requests such as
+// exchanging a refresh token.
+func (t *Throttle) Wait(ctx context.Context, token string) error {
+	if token != "" {
+		err := t.token(token).Wait(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return t.app.Wait(ctx)
+}
+
+// Do runs op, a request made with token, once the throttle allows it and
+// retries it according to p. When toodledo says too many requests have been
+// made, requests with token wait for RateLimitPause and op is tried again.
+// Once it has waited MaxRateLimitPauses times the error is returned without
+// being retried.
+func (t *Throttle) Do(ctx context.Context, token string, p retry.Policy, op func() error) error {
+	for pauses := 0; ; pauses++ {
+		err := retry.Do(ctx, p, func() error {
+			err := t.Wait(ctx, token)
+			if err != nil {
+				return err
+			}
+
+			err = op()
+			if isRateLimited(err) {
+				// Retrying straight away would only be turned away again
+				return retry.Permanent(err)
+			}
+			return err
+		})
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !apiErr.RateLimited() {
+			return err
+		}
+		if pauses >= MaxRateLimitPauses {
+			return apiErr
+		}
+		t.Pause(token, RateLimitPause)
+	}
+}
+
+// Pause stops requests with token for d, and every request for
+// AppRateLimitPause or d if that is shorter
+func (t *Throttle) Pause(token string, d time.Duration) {
+	if token != "" {
+		t.token(token).Pause(d)
+	}
+	if d > AppRateLimitPause {
+		d = AppRateLimitPause
+	}
+	t.app.Pause(d)
+}
+
+// token returns the rate for token, creating it on first use. Tokens change
+// every backup, so ones that haven't been used for an hour are forgotten.
+func (t *Throttle) token(token string) *limits.Rate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) > 10*time.Minute {
+		for k, rate := range t.tokens {
+			if rate.Idle(now.Add(-time.Hour)) {
+				delete(t.tokens, k)
+			}
+		}
+		t.lastSweep = now
+	}
+
+	rate, ok := t.tokens[token]
+	if !ok {
+		rate = limits.NewRate(t.tokenRate, t.tokenRate/6)
+		t.tokens[token] = rate
+	}
+	return rate
+}
+
+// isRateLimited reports whether toodledo turned a request away for being
+// over its rate limit
+func isRateLimited(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.RateLimited()
+}
@@ -1,7 +1,10 @@
 package toodledo
 
 import (
+	"bytes"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -13,6 +16,70 @@ import (
 	"github.com/jarota/ToodleBackupBackend/user"
 )
 
+// ErrInvalidToken is returned when a token is missing, invalid or revoked
+var ErrInvalidToken = errors.New("toodledo: invalid token")
+
+// APIError describes an error response from toodledo. Code is toodledo's
+// errorCode, or 0 when the response didn't include one.
+type APIError struct {
+	StatusCode  int
+	Code        int
+	Description string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("toodledo: status %d: error %d: %s", e.StatusCode, e.Code, e.Description)
+}
+
+// Is lets errors.Is match an APIError against ErrInvalidToken
+func (e *APIError) Is(target error) bool {
+	return target == ErrInvalidToken && (e.Code == 1 || e.Code == 2 || e.StatusCode == http.StatusUnauthorized)
+}
+
+// Temporary reports whether the request may succeed if retried, when toodledo
+// is rate limiting us, down for maintenance or failing
+func (e *APIError) Temporary() bool {
+	return e.RateLimited() || e.Code == 4 || e.StatusCode >= 500
+}
+
+// RateLimited reports whether toodledo turned the request away for making
+// too many requests, or too many token requests (code 103)
+func (e *APIError) RateLimited() bool {
+	return e.Code == 3 || e.Code == 103 || e.StatusCode == http.StatusTooManyRequests
+}
+
+type errorResponse struct {
+	ErrorCode int    `json:"errorCode"`
+	ErrorDesc string `json:"errorDesc"`
+}
+
+type xmlError struct {
+	XMLName xml.Name
+	ID      int    `xml:"id,attr"`
+	Desc    string `xml:",chardata"`
+}
+
+// ResponseError returns an APIError if a json or xml response from toodledo
+// is an error, and nil otherwise
+func ResponseError(statusCode int, data []byte) error {
+	var errResp errorResponse
+	var xmlErr xmlError
+	trimmed := bytes.TrimSpace(data)
+
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")) && json.Unmarshal(trimmed, &errResp) == nil && errResp.ErrorCode != 0:
+		// errResp already holds the error
+	case bytes.HasPrefix(trimmed, []byte("<")) && xml.Unmarshal(trimmed, &xmlErr) == nil && xmlErr.XMLName.Local == "error":
+		errResp = errorResponse{ErrorCode: xmlErr.ID, ErrorDesc: xmlErr.Desc}
+	case statusCode == http.StatusOK:
+		return nil
+	default:
+		errResp.ErrorDesc = string(trimmed)
+	}
+
+	return &APIError{StatusCode: statusCode, Code: errResp.ErrorCode, Description: errResp.ErrorDesc}
+}
+
 type toodleResponse struct {
 	AccessToken  string `json:"access_token"`
 	ExpiresIn    int    `json:"expires_in"`
@@ -29,8 +96,6 @@ func GetToodledoTokens(code string, grantType string) (*user.ToodleInfo, error)
 
 	client := &http.Client{}
 
-	apiURL := "https://api.toodledo.com"
-	resource := "/3/account/token.php"
 	data := url.Values{}
 	data.Set("grant_type", grantType)
 	if grantType == "authorization_code" {
@@ -39,9 +104,7 @@ func GetToodledoTokens(code string, grantType string) (*user.ToodleInfo, error)
 		data.Set("refresh_token", code)
 	}
 
-	u, _ := url.ParseRequestURI(apiURL)
-	u.Path = resource
-	urlStr := u.String()
+	urlStr := strings.TrimRight(DefaultBaseURL, "/") + "/account/token.php"
 
 	req, _ := http.NewRequest(http.MethodPost, urlStr, strings.NewReader(data.Encode()))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
@@ -56,14 +119,19 @@ func GetToodledoTokens(code string, grantType string) (*user.ToodleInfo, error)
 
 	defer resp.Body.Close()
 
-	bytes, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
 
+	err = ResponseError(resp.StatusCode, body)
 	if err != nil {
 		return nil, err
 	}
 
 	var toodleResp toodleResponse
-	json.Unmarshal(bytes, &toodleResp)
+	json.Unmarshal(body, &toodleResp)
 	// printResponse(&toodleResp)
 
 	return responseToInfo(&toodleResp), nil
@@ -0,0 +1,322 @@
+package toodledo
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strconv"
+)
+
+// Int is a number from toodledo, which sends some numbers as json strings
+type Int int64
+
+// UnmarshalJSON accepts both 123 and "123", treating "" and null as 0
+func (n *Int) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	if len(data) == 0 || string(data) == "null" {
+		*n = 0
+		return nil
+	}
+	i, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = Int(i)
+	return nil
+}
+
+// TaskFields are the optional task fields held by Task, toodledo only sends
+// the ones asked for
+var TaskFields = []string{
+	"folder", "context", "goal", "location", "tag", "startdate", "duedate",
+	"duedatemod", "starttime", "duetime", "remind", "repeat", "status", "star",
+	"priority", "length", "timer", "added", "note", "parent", "children",
+	"order", "meta", "previous", "attachment", "shared", "addedby", "via",
+	"attachments",
+}
+
+// Account is the user's toodledo account. The lastedit and lastdelete fields
+// are when each kind of item was last changed, as unix timestamps.
+type Account struct {
+	XMLName          xml.Name `json:"-" xml:"account"`
+	UserID           string   `json:"userid" xml:"userid"`
+	Alias            string   `json:"alias" xml:"alias"`
+	Email            string   `json:"email" xml:"email"`
+	Pro              Int      `json:"pro" xml:"pro"`
+	DateFormat       Int      `json:"dateformat" xml:"dateformat"`
+	Timezone         Int      `json:"timezone" xml:"timezone"`
+	HideMonths       Int      `json:"hidemonths" xml:"hidemonths"`
+	HotlistPriority  Int      `json:"hotlistpriority" xml:"hotlistpriority"`
+	HotlistDueDate   Int      `json:"hotlistduedate" xml:"hotlistduedate"`
+	HotlistStar      Int      `json:"hotliststar" xml:"hotliststar"`
+	HotlistStatus    Int      `json:"hotliststatus" xml:"hotliststatus"`
+	ShowTabNums      Int      `json:"showtabnums" xml:"showtabnums"`
+	LastEditFolder   Int      `json:"lastedit_folder" xml:"lastedit_folder"`
+	LastEditContext  Int      `json:"lastedit_context" xml:"lastedit_context"`
+	LastEditGoal     Int      `json:"lastedit_goal" xml:"lastedit_goal"`
+	LastEditLocation Int      `json:"lastedit_location" xml:"lastedit_location"`
+	LastEditTask     Int      `json:"lastedit_task" xml:"lastedit_task"`
+	LastDeleteTask   Int      `json:"lastdelete_task" xml:"lastdelete_task"`
+	LastEditNote     Int      `json:"lastedit_note" xml:"lastedit_note"`
+	LastDeleteNote   Int      `json:"lastdelete_note" xml:"lastdelete_note"`
+	LastEditList     Int      `json:"lastedit_list" xml:"lastedit_list"`
+	LastEditOutline  Int      `json:"lastedit_outline" xml:"lastedit_outline"`
+	Extra            Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// Attachment is a file or link attached to a task
+type Attachment struct {
+	ID    Int    `json:"id" xml:"id"`
+	Kind  string `json:"kind" xml:"kind"`
+	Name  string `json:"name" xml:"name"`
+	Link  string `json:"link" xml:"link"`
+	Extra Extra  `json:"-" xml:"extra,omitempty"`
+}
+
+// Task is a task with every field in TaskFields. Dates are unix timestamps.
+type Task struct {
+	XMLName     xml.Name     `json:"-" xml:"task"`
+	ID          Int          `json:"id" xml:"id"`
+	Title       string       `json:"title" xml:"title"`
+	Modified    Int          `json:"modified" xml:"modified"`
+	Completed   Int          `json:"completed" xml:"completed"`
+	Folder      Int          `json:"folder" xml:"folder"`
+	Context     Int          `json:"context" xml:"context"`
+	Goal        Int          `json:"goal" xml:"goal"`
+	Location    Int          `json:"location" xml:"location"`
+	Tag         string       `json:"tag" xml:"tag"`
+	StartDate   Int          `json:"startdate" xml:"startdate"`
+	DueDate     Int          `json:"duedate" xml:"duedate"`
+	DueDateMod  Int          `json:"duedatemod" xml:"duedatemod"`
+	StartTime   Int          `json:"starttime" xml:"starttime"`
+	DueTime     Int          `json:"duetime" xml:"duetime"`
+	Remind      Int          `json:"remind" xml:"remind"`
+	Repeat      string       `json:"repeat" xml:"repeat"`
+	Status      Int          `json:"status" xml:"status"`
+	Star        Int          `json:"star" xml:"star"`
+	Priority    Int          `json:"priority" xml:"priority"`
+	Length      Int          `json:"length" xml:"length"`
+	Timer       Int          `json:"timer" xml:"timer"`
+	Added       Int          `json:"added" xml:"added"`
+	Note        string       `json:"note" xml:"note"`
+	Parent      Int          `json:"parent" xml:"parent"`
+	Children    Int          `json:"children" xml:"children"`
+	Order       Int          `json:"order" xml:"order"`
+	Meta        string       `json:"meta" xml:"meta"`
+	Previous    Int          `json:"previous" xml:"previous"`
+	Attachment  Int          `json:"attachment" xml:"attachment"`
+	Shared      Int          `json:"shared" xml:"shared"`
+	AddedBy     string       `json:"addedby" xml:"addedby"`
+	Via         Int          `json:"via" xml:"via"`
+	Attachments []Attachment `json:"attachments" xml:"attachments>attachment"`
+	Extra       Extra        `json:"-" xml:"extra,omitempty"`
+}
+
+// Deletion records an item being deleted at Stamp, a unix timestamp
+type Deletion struct {
+	XMLName xml.Name `json:"-" xml:"deleted"`
+	ID      Int      `json:"id" xml:"id"`
+	Stamp   Int      `json:"stamp" xml:"stamp"`
+}
+
+// Folder groups tasks and notes
+type Folder struct {
+	XMLName  xml.Name `json:"-" xml:"folder"`
+	ID       Int      `json:"id" xml:"id"`
+	Name     string   `json:"name" xml:"name"`
+	Private  Int      `json:"private" xml:"private"`
+	Archived Int      `json:"archived" xml:"archived"`
+	Order    Int      `json:"ord" xml:"order"`
+	Extra    Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// Context is where or how a task can be done
+type Context struct {
+	XMLName xml.Name `json:"-" xml:"context"`
+	ID      Int      `json:"id" xml:"id"`
+	Name    string   `json:"name" xml:"name"`
+	Private Int      `json:"private" xml:"private"`
+	Extra   Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// Goal is something tasks contribute towards
+type Goal struct {
+	XMLName     xml.Name `json:"-" xml:"goal"`
+	ID          Int      `json:"id" xml:"id"`
+	Name        string   `json:"name" xml:"name"`
+	Level       Int      `json:"level" xml:"level"`
+	Archived    Int      `json:"archived" xml:"archived"`
+	Contributes Int      `json:"contributes" xml:"contributes"`
+	Note        string   `json:"note" xml:"note"`
+	Extra       Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// Location is a place tasks can be done
+type Location struct {
+	XMLName     xml.Name    `json:"-" xml:"location"`
+	ID          Int         `json:"id" xml:"id"`
+	Name        string      `json:"name" xml:"name"`
+	Description string      `json:"description" xml:"description"`
+	Lat         json.Number `json:"lat" xml:"lat"`
+	Lon         json.Number `json:"lon" xml:"lon"`
+	Extra       Extra       `json:"-" xml:"extra,omitempty"`
+}
+
+// Note is a note, Text is its content
+type Note struct {
+	XMLName  xml.Name `json:"-" xml:"note"`
+	ID       Int      `json:"id" xml:"id"`
+	Title    string   `json:"title" xml:"title"`
+	Modified Int      `json:"modified" xml:"modified"`
+	Added    Int      `json:"added" xml:"added"`
+	Folder   Int      `json:"folder" xml:"folder"`
+	Private  Int      `json:"private" xml:"private"`
+	Text     string   `json:"text" xml:"text"`
+	Extra    Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// Outline is an outline, Count is how many rows it has. Toodledo sends the
+// rows along with the outline, and they are kept in Extra.
+type Outline struct {
+	XMLName  xml.Name `json:"-" xml:"outline"`
+	ID       Int      `json:"id" xml:"id"`
+	Title    string   `json:"title" xml:"title"`
+	Modified Int      `json:"modified" xml:"modified"`
+	Added    Int      `json:"added" xml:"added"`
+	Hidden   Int      `json:"hidden" xml:"hidden"`
+	Count    Int      `json:"count" xml:"count"`
+	Extra    Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// List is a list, Count is how many rows it has. Rows are fetched separately
+// with Client.Rows.
+type List struct {
+	XMLName  xml.Name `json:"-" xml:"list"`
+	ID       Int      `json:"id" xml:"id"`
+	Title    string   `json:"title" xml:"title"`
+	Modified Int      `json:"modified" xml:"modified"`
+	Added    Int      `json:"added" xml:"added"`
+	Note     string   `json:"note" xml:"note"`
+	Keywords string   `json:"keywords" xml:"keywords"`
+	Archived Int      `json:"archived" xml:"archived"`
+	Count    Int      `json:"count" xml:"count"`
+	Rows     []Row    `json:"-" xml:"rows>row"`
+	Extra    Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// Row is a row of a list, its cells are kept in Extra
+type Row struct {
+	XMLName  xml.Name `json:"-" xml:"row"`
+	ID       Int      `json:"id" xml:"id"`
+	Modified Int      `json:"modified" xml:"modified"`
+	Added    Int      `json:"added" xml:"added"`
+	Extra    Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// Habit is a habit being tracked
+type Habit struct {
+	XMLName  xml.Name `json:"-" xml:"habit"`
+	ID       Int      `json:"id" xml:"id"`
+	Title    string   `json:"title" xml:"title"`
+	Modified Int      `json:"modified" xml:"modified"`
+	Added    Int      `json:"added" xml:"added"`
+	Archived Int      `json:"archived" xml:"archived"`
+	Note     string   `json:"note" xml:"note"`
+	Extra    Extra    `json:"-" xml:"extra,omitempty"`
+}
+
+// UnmarshalJSON decodes an account, keeping unknown fields in Extra
+func (a *Account) UnmarshalJSON(data []byte) error {
+	type plain Account
+	extra, err := unmarshalExtra(data, (*plain)(a))
+	a.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes an attachment, keeping unknown fields in Extra
+func (a *Attachment) UnmarshalJSON(data []byte) error {
+	type plain Attachment
+	extra, err := unmarshalExtra(data, (*plain)(a))
+	a.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a task, keeping unknown fields in Extra
+func (t *Task) UnmarshalJSON(data []byte) error {
+	type plain Task
+	extra, err := unmarshalExtra(data, (*plain)(t))
+	t.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a folder, keeping unknown fields in Extra
+func (f *Folder) UnmarshalJSON(data []byte) error {
+	type plain Folder
+	extra, err := unmarshalExtra(data, (*plain)(f))
+	f.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a context, keeping unknown fields in Extra
+func (c *Context) UnmarshalJSON(data []byte) error {
+	type plain Context
+	extra, err := unmarshalExtra(data, (*plain)(c))
+	c.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a goal, keeping unknown fields in Extra
+func (g *Goal) UnmarshalJSON(data []byte) error {
+	type plain Goal
+	extra, err := unmarshalExtra(data, (*plain)(g))
+	g.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a location, keeping unknown fields in Extra
+func (l *Location) UnmarshalJSON(data []byte) error {
+	type plain Location
+	extra, err := unmarshalExtra(data, (*plain)(l))
+	l.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a note, keeping unknown fields in Extra
+func (n *Note) UnmarshalJSON(data []byte) error {
+	type plain Note
+	extra, err := unmarshalExtra(data, (*plain)(n))
+	n.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes an outline, keeping unknown fields in Extra
+func (o *Outline) UnmarshalJSON(data []byte) error {
+	type plain Outline
+	extra, err := unmarshalExtra(data, (*plain)(o))
+	o.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a list, keeping unknown fields in Extra
+func (l *List) UnmarshalJSON(data []byte) error {
+	type plain List
+	extra, err := unmarshalExtra(data, (*plain)(l))
+	l.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a habit, keeping unknown fields in Extra
+func (h *Habit) UnmarshalJSON(data []byte) error {
+	type plain Habit
+	extra, err := unmarshalExtra(data, (*plain)(h))
+	h.Extra = extra
+	return err
+}
+
+// UnmarshalJSON decodes a row, keeping unknown fields in Extra
+func (r *Row) UnmarshalJSON(data []byte) error {
+	type plain Row
+	extra, err := unmarshalExtra(data, (*plain)(r))
+	r.Extra = extra
+	return err
+}
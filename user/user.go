@@ -12,37 +12,115 @@ type ToodleInfo struct {
 	ToBackup []string `json:"toBackup"`
 }
 
-// Cloud type to contain cloud service token
+// Cloud type to contain cloud service token, Config holds any provider
+// specific settings such as a bucket or folder. Retention overrides the
+// user's retention policy for this cloud when set, and Error holds why the
+// last upload failed if it won't work without the user's help.
 type Cloud struct {
-	Name  string `json:"name"`
-	Token string `json:"token"`
+	Name      string            `json:"name"`
+	Token     string            `json:"token"`
+	Config    map[string]string `json:"config,omitempty"`
+	Retention *Retention        `json:"retention,omitempty"`
+	Error     string            `json:"error,omitempty"`
 }
 
-// BackupTime describes the time at which the user's data should be backed up
+// Retention describes which old backups to keep, grandfather-father-son style.
+// A rule set to 0 is disabled, and if every rule is 0 all backups are kept.
+type Retention struct {
+	KeepLast    int `json:"keepLast"`
+	KeepDaily   int `json:"keepDaily"`
+	KeepWeekly  int `json:"keepWeekly"`
+	KeepMonthly int `json:"keepMonthly"`
+}
+
+// Frequency describes how often the user's data should be backed up
+type Frequency string
+
+// Supported backup frequencies
+const (
+	Hourly  Frequency = "hourly"
+	Daily   Frequency = "daily"
+	Weekly  Frequency = "weekly"
+	Monthly Frequency = "monthly"
+)
+
+// Valid reports whether f is one of the supported frequencies
+func (f Frequency) Valid() bool {
+	switch f {
+	case Hourly, Daily, Weekly, Monthly:
+		return true
+	}
+	return false
+}
+
+// BackupTime describes the time at which the user's data should be backed up.
+// Hourly backups only use Minute and Second, Weekday is used by weekly backups
+// and Day, the day of the month, by monthly ones.
 type BackupTime struct {
-	Hour   int `json:"hour"`
-	Minute int `json:"minute"`
-	Second int `json:"second"`
+	Hour    int          `json:"hour"`
+	Minute  int          `json:"minute"`
+	Second  int          `json:"second"`
+	Weekday time.Weekday `json:"weekday"`
+	Day     int          `json:"day"`
+}
+
+// Valid reports whether every field of the backup time is in range
+func (t BackupTime) Valid() bool {
+	return t.Hour >= 0 && t.Hour < 24 &&
+		t.Minute >= 0 && t.Minute < 60 &&
+		t.Second >= 0 && t.Second < 60 &&
+		t.Weekday >= time.Sunday && t.Weekday <= time.Saturday &&
+		t.Day >= 0 && t.Day <= 31
+}
+
+// ToodleEdits holds when each kind of item was last changed in toodledo, as
+// unix timestamps, so a backup can tell what has changed since the last one
+type ToodleEdits struct {
+	Folder     int64 `json:"folder"`
+	Context    int64 `json:"context"`
+	Goal       int64 `json:"goal"`
+	Location   int64 `json:"location"`
+	Task       int64 `json:"task"`
+	TaskDelete int64 `json:"taskDelete"`
+	Note       int64 `json:"note"`
+	NoteDelete int64 `json:"noteDelete"`
+	List       int64 `json:"list"`
+	Outline    int64 `json:"outline"`
 }
 
 // User type containing all user info - Time is the time to backup the data
+// in the user's Timezone, Cron an optional cron expression used instead of
+// Frequency and Time, NextRun when the scheduler will next back it up,
+// LastSuccess when a backup last reached at least one cloud and BackupError
+// why the last backup failed if retrying won't help, such as a revoked token.
+// LastFull is when a full backup last reached every cloud, and LastEdits what
+// toodledo said had changed when the last backup to reach every cloud started.
 type User struct {
-	Username  string     `json:"username"`
-	Password  string     `json:"password"`
-	Frequency string     `json:"frequency"`
-	Time      BackupTime `json:"time"`
-	Toodledo  ToodleInfo `json:"toodledo"`
-	Clouds    []Cloud    `json:"clouds"`
+	Username    string      `json:"username"`
+	Password    string      `json:"password"`
+	Frequency   Frequency   `json:"frequency"`
+	Time        BackupTime  `json:"time"`
+	Cron        string      `json:"cron,omitempty"`
+	Timezone    string      `json:"timezone,omitempty"`
+	NextRun     time.Time   `json:"nextRun"`
+	LastSuccess time.Time   `json:"lastSuccess"`
+	BackupError string      `json:"backupError,omitempty"`
+	LastFull    time.Time   `json:"lastFull"`
+	LastEdits   ToodleEdits `json:"lastEdits"`
+	Toodledo    ToodleInfo  `json:"toodledo"`
+	Clouds      []Cloud     `json:"clouds"`
+	Retention   Retention   `json:"retention"`
 }
 
 // New creates a new skeleton user from a username and password
 func New(name string, pass string) *User {
-	h, m, s := time.Now().UTC().Clock()
-	now := BackupTime{Hour: h, Minute: (m + 10), Second: s}
+	t := time.Now().UTC().Add(10 * time.Minute)
+	h, m, s := t.Clock()
+	now := BackupTime{Hour: h, Minute: m, Second: s, Weekday: t.Weekday(), Day: t.Day()}
 	u := User{
 		Username:  name,
 		Password:  pass,
-		Frequency: "",
+		Frequency: Daily,
 		Time:      now,
 		Toodledo:  ToodleInfo{Token: "", Refresh: "", ToBackup: []string{}},
 		Clouds:    []Cloud{},
@@ -50,6 +128,18 @@ func New(name string, pass string) *User {
 	return &u
 }
 
+// Location returns the user's timezone, UTC if they haven't set one
+func (u *User) Location() *time.Location {
+	if u.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
 // Print - certain attributes of a given user
 func (u *User) Print() {
 	fmt.Println()
@@ -0,0 +1,285 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/retry"
+)
+
+// ErrNotFound is returned when a resource does not exist on the server
+var ErrNotFound = errors.New("webdav: not found")
+
+// StatusError describes an unexpected response status from the server
+type StatusError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webdav: %s: status %d", e.Method, e.StatusCode)
+}
+
+// Is lets errors.Is match a StatusError against ErrNotFound
+func (e *StatusError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *StatusError) Temporary() bool {
+	return retry.StatusTemporary(e.StatusCode)
+}
+
+// Resource is a file or collection returned by PROPFIND
+type Resource struct {
+	Name         string
+	Collection   bool
+	Size         int64
+	LastModified time.Time
+}
+
+// Client talks to a webdav server, such as nextcloud, with basic auth
+type Client struct {
+	URL        string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <d:quota-used-bytes/>
+    <d:quota-available-bytes/>
+  </d:prop>
+</d:propfind>`
+
+type prop struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength       string `xml:"DAV: getcontentlength"`
+	LastModified        string `xml:"DAV: getlastmodified"`
+	QuotaUsedBytes      string `xml:"DAV: quota-used-bytes"`
+	QuotaAvailableBytes string `xml:"DAV: quota-available-bytes"`
+}
+
+type propstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   prop   `xml:"DAV: prop"`
+}
+
+type response struct {
+	Href     string     `xml:"DAV: href"`
+	Propstat []propstat `xml:"DAV: propstat"`
+}
+
+type multistatus struct {
+	Responses []response `xml:"DAV: response"`
+}
+
+// Put uploads size bytes from r to the file at p. A negative size means unknown.
+func (c *Client) Put(ctx context.Context, p string, r io.Reader, size int64) error {
+	req, err := c.request(ctx, http.MethodPut, p, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	_, err = c.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+// MkdirAll creates the collection at p along with any missing parents
+func (c *Client) MkdirAll(ctx context.Context, p string) error {
+	dir := ""
+	for _, segment := range strings.Split(strings.Trim(p, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		dir += "/" + segment
+
+		req, err := c.request(ctx, "MKCOL", dir, nil)
+		if err != nil {
+			return err
+		}
+		// 405 means the collection already exists
+		_, err = c.do(req, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the resource at p
+func (c *Client) Delete(ctx context.Context, p string) error {
+	req, err := c.request(ctx, http.MethodDelete, p, nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(req, http.StatusOK, http.StatusNoContent)
+	return err
+}
+
+// ReadDir returns the resources inside the collection at p
+func (c *Client) ReadDir(ctx context.Context, p string) ([]Resource, error) {
+	ms, err := c.propfind(ctx, p, "1")
+	if err != nil {
+		return nil, err
+	}
+
+	self := strings.TrimSuffix(c.resolve(p).Path, "/")
+	var resources []Resource
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		// The collection itself is included in the response
+		if strings.TrimSuffix(href.Path, "/") == self {
+			continue
+		}
+		resources = append(resources, toResource(href.Path, r.Propstat))
+	}
+	return resources, nil
+}
+
+// Stat returns the resource at p
+func (c *Client) Stat(ctx context.Context, p string) (*Resource, error) {
+	ms, err := c.propfind(ctx, p, "0")
+	if err != nil {
+		return nil, err
+	}
+	if len(ms.Responses) == 0 {
+		return nil, ErrNotFound
+	}
+
+	r := toResource(p, ms.Responses[0].Propstat)
+	return &r, nil
+}
+
+// Quota returns the bytes used and available in the collection at p, as
+// reported by RFC 4331. Available is negative when the server has no limit.
+func (c *Client) Quota(ctx context.Context, p string) (used int64, available int64, err error) {
+	ms, err := c.propfind(ctx, p, "0")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	available = -1
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if v, err := strconv.ParseInt(ps.Prop.QuotaUsedBytes, 10, 64); err == nil {
+				used = v
+			}
+			if v, err := strconv.ParseInt(ps.Prop.QuotaAvailableBytes, 10, 64); err == nil {
+				available = v
+			}
+		}
+	}
+	return used, available, nil
+}
+
+func (c *Client) propfind(ctx context.Context, p string, depth string) (*multistatus, error) {
+	req, err := c.request(ctx, "PROPFIND", p, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	data, err := c.do(req, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms multistatus
+	err = xml.Unmarshal(data, &ms)
+	if err != nil {
+		return nil, err
+	}
+	return &ms, nil
+}
+
+func toResource(p string, propstats []propstat) Resource {
+	r := Resource{Name: path.Base(strings.TrimSuffix(p, "/"))}
+	for _, ps := range propstats {
+		if !strings.Contains(ps.Status, " 200 ") {
+			continue
+		}
+		if ps.Prop.ResourceType.Collection != nil {
+			r.Collection = true
+		}
+		if v, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+			r.Size = v
+		}
+		if t, err := http.ParseTime(ps.Prop.LastModified); err == nil {
+			r.LastModified = t
+		}
+	}
+	return r
+}
+
+// resolve joins p onto the client's base url
+func (c *Client) resolve(p string) *url.URL {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		u = &url.URL{}
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(p, "/")
+	u.RawPath = ""
+	return u
+}
+
+func (c *Client) request(ctx context.Context, method string, p string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.resolve(p).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+	return req, nil
+}
+
+// do sends req and returns the response body, failing unless the status is one of ok
+func (c *Client) do(req *http.Request, ok ...int) ([]byte, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return data, nil
+		}
+	}
+	return nil, &StatusError{Method: req.Method, StatusCode: resp.StatusCode}
+}
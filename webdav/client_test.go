@@ -0,0 +1,220 @@
+package webdav
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// fakeDAV keeps a tree of collections and files in memory under root, the
+// way nextcloud serves each user's files below their own path
+type fakeDAV struct {
+	t     *testing.T
+	root  string
+	quota int64
+
+	mu          sync.Mutex
+	collections map[string]bool
+	files       map[string][]byte
+}
+
+func newFakeDAV(t *testing.T, root string) *fakeDAV {
+	return &fakeDAV{t: t, root: root, quota: 1 << 20, collections: map[string]bool{root: true}, files: map[string][]byte{}}
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	username, password, _ := r.BasicAuth()
+	if username != "alice" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	if !strings.HasPrefix(p, f.root) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch r.Method {
+	case "MKCOL":
+		switch {
+		case f.collections[p] || f.files[p] != nil:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case !f.collections[path.Dir(p)]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			f.collections[p] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodPut:
+		if !f.collections[path.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if r.ContentLength >= 0 && r.ContentLength != int64(len(body)) {
+			f.t.Errorf("PUT %s: Content-Length %d but %d bytes sent", p, r.ContentLength, len(body))
+		}
+		status := http.StatusCreated
+		if f.files[p] != nil {
+			status = http.StatusNoContent
+		}
+		f.files[p] = body
+		w.WriteHeader(status)
+	case http.MethodDelete:
+		if f.files[p] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, p)
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		f.propfind(w, p, r.Header.Get("Depth"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeDAV) propfind(w http.ResponseWriter, p string, depth string) {
+	if !f.collections[p] && f.files[p] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	hrefs := []string{p}
+	if depth == "1" {
+		for child := range f.collections {
+			if path.Dir(child) == p && child != p {
+				hrefs = append(hrefs, child)
+			}
+		}
+		for child := range f.files {
+			if path.Dir(child) == p {
+				hrefs = append(hrefs, child)
+			}
+		}
+		sort.Strings(hrefs[1:])
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:">`)
+	modified := time.Now().UTC().Format(http.TimeFormat)
+	for _, href := range hrefs {
+		if f.collections[href] {
+			fmt.Fprintf(w, `<d:response><d:href>%s/</d:href><d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype>`+
+				`<d:quota-used-bytes>%d</d:quota-used-bytes><d:quota-available-bytes>%d</d:quota-available-bytes>`+
+				`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>`+
+				`<d:propstat><d:prop><d:getcontentlength/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat></d:response>`,
+				href, f.used(), f.quota-f.used())
+			continue
+		}
+		fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:resourcetype/>`+
+			`<d:getcontentlength>%d</d:getcontentlength><d:getlastmodified>%s</d:getlastmodified>`+
+			`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`,
+			href, len(f.files[href]), modified)
+	}
+	fmt.Fprint(w, `</d:multistatus>`)
+}
+
+func (f *fakeDAV) used() int64 {
+	var used int64
+	for _, data := range f.files {
+		used += int64(len(data))
+	}
+	return used
+}
+
+func TestDestination(t *testing.T) {
+	const root = "/remote.php/dav/files/alice"
+	fake := newFakeDAV(t, root)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	ctx := context.Background()
+	cloud, err := Connect(ctx, &Config{URL: srv.URL + root + "/", Folder: "Backups/Toodledo", Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fake.collections[root+"/Backups/Toodledo"] {
+		t.Fatalf("Connect() didn't create the backup folder, server has %v", fake.collections)
+	}
+
+	dest, err := storage.Open(ctx, &user.User{}, cloud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.Upload(ctx, "a.xml", strings.NewReader("first"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.Upload(ctx, "b.xml", strings.NewReader("second"), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.collections[root+"/Backups/Toodledo/old"] = true
+
+	files, err := dest.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "a.xml" || files[1].Name != "b.xml" || files[1].Size != 6 {
+		t.Errorf("List() = %+v, want the two backups but not the folder", files)
+	}
+
+	quota, err := dest.Quota(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.Used != 11 || quota.Total != fake.quota {
+		t.Errorf("Quota() = %+v, want 11 bytes of %d used", quota, fake.quota)
+	}
+
+	err = dest.Delete(ctx, "a.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dest.Delete(ctx, "a.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("deleting a missing file returned %v, want storage.ErrNotFound", err)
+	}
+	_, err = dest.Stat(ctx, "a.xml")
+	if err != storage.ErrNotFound {
+		t.Errorf("Stat() of a deleted file returned %v, want storage.ErrNotFound", err)
+	}
+
+	// The folder is put back if the user removes it
+	delete(fake.collections, root+"/Backups/Toodledo")
+	delete(fake.collections, root+"/Backups")
+	err = dest.Upload(ctx, "c.xml", strings.NewReader("third"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.files[root+"/Backups/Toodledo/c.xml"]) != "third" {
+		t.Errorf("c.xml holds %q", fake.files[root+"/Backups/Toodledo/c.xml"])
+	}
+}
+
+func TestConnectBadPassword(t *testing.T) {
+	srv := httptest.NewServer(newFakeDAV(t, "/dav"))
+	defer srv.Close()
+
+	_, err := Connect(context.Background(), &Config{URL: srv.URL + "/dav", Username: "alice", Password: "wrong"})
+	if se, ok := err.(*StatusError); !ok || se.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Connect() with the wrong password returned %v, want a 401", err)
+	}
+}
@@ -0,0 +1,133 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/jarota/ToodleBackupBackend/storage"
+	"github.com/jarota/ToodleBackupBackend/user"
+)
+
+// Name is the cloud name webdav destinations are registered under
+const Name = "WebDAV"
+
+func init() {
+	storage.Register(Name, open)
+}
+
+// Config describes how to reach a user's webdav server. For nextcloud URL is
+// usually https://<host>/remote.php/dav/files/<username> and Password an app password.
+type Config struct {
+	URL      string `json:"url"`
+	Folder   string `json:"folder"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Connect checks the server can be reached with the given credentials, creates
+// the backup folder, and returns the cloud to store for the user
+func Connect(ctx context.Context, cfg *Config) (*user.Cloud, error) {
+	if cfg.URL == "" || cfg.Username == "" {
+		return nil, errors.New("webdav: url and username are required")
+	}
+
+	client := &Client{URL: cfg.URL, Username: cfg.Username, Password: cfg.Password}
+	_, err := client.Stat(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	err = client.MkdirAll(ctx, cfg.Folder)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user.Cloud{
+		Name:  Name,
+		Token: cfg.Password,
+		Config: map[string]string{
+			"url":      cfg.URL,
+			"folder":   cfg.Folder,
+			"username": cfg.Username,
+		},
+	}, nil
+}
+
+// destination stores backups in a single collection on a webdav server
+type destination struct {
+	client *Client
+	folder string
+}
+
+func open(_ context.Context, _ *user.User, c *user.Cloud) (storage.Destination, error) {
+	client := &Client{
+		URL:      c.Config["url"],
+		Username: c.Config["username"],
+		Password: c.Token,
+	}
+	return &destination{client: client, folder: strings.Trim(c.Config["folder"], "/")}, nil
+}
+
+func (d *destination) path(name string) string {
+	if d.folder == "" {
+		return name
+	}
+	return d.folder + "/" + name
+}
+
+func (d *destination) Upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	// The folder may have been removed since the user connected
+	err := d.client.MkdirAll(ctx, d.folder)
+	if err != nil {
+		return err
+	}
+	return d.client.Put(ctx, d.path(name), r, size)
+}
+
+func (d *destination) List(ctx context.Context) ([]storage.FileInfo, error) {
+	resources, err := d.client.ReadDir(ctx, d.folder)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storage.FileInfo, 0, len(resources))
+	for _, r := range resources {
+		if !r.Collection {
+			files = append(files, storage.FileInfo{Name: r.Name, Size: r.Size, Modified: r.LastModified})
+		}
+	}
+	return files, nil
+}
+
+func (d *destination) Delete(ctx context.Context, name string) error {
+	return notFound(d.client.Delete(ctx, d.path(name)))
+}
+
+func (d *destination) Stat(ctx context.Context, name string) (*storage.FileInfo, error) {
+	r, err := d.client.Stat(ctx, d.path(name))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &storage.FileInfo{Name: name, Size: r.Size, Modified: r.LastModified}, nil
+}
+
+func (d *destination) Quota(ctx context.Context) (*storage.Quota, error) {
+	used, available, err := d.client.Quota(ctx, d.folder)
+	if err != nil {
+		return nil, err
+	}
+
+	quota := &storage.Quota{Used: used}
+	if available >= 0 {
+		quota.Total = used + available
+	}
+	return quota, nil
+}
+
+func notFound(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return storage.ErrNotFound
+	}
+	return err
+}